@@ -0,0 +1,367 @@
+package main
+
+import (
+	"encoding/base64"
+	"encoding/json"
+	"log"
+	"net/http"
+	"net/url"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+)
+
+const (
+	defaultAPILimit = 100
+	maxAPILimit     = 1000
+)
+
+// reportFilter selects the reports returned by /api/reports
+type reportFilter struct {
+	directive string
+	blocked   string
+	from, to  time.Time
+}
+
+func (f reportFilter) match(rec record) bool {
+	if f.directive != "" && rec.directive() != f.directive {
+		return false
+	}
+	if f.blocked != "" && (rec.Report == nil || !strings.Contains(rec.Report.BlockedURI, f.blocked)) {
+		return false
+	}
+	if !f.from.IsZero() && rec.Time.Before(f.from) {
+		return false
+	}
+	if !f.to.IsZero() && rec.Time.After(f.to) {
+		return false
+	}
+	return true
+}
+
+// apiCursor is the position of the next report to return. Reports are read
+// domain by domain, from every archive in the order they were created and
+// then from the pending reports. Archives and pending reports are read file
+// by file in the order the files are written to the zip.
+type apiCursor struct {
+	Domain string `json:"d"`
+	// Archive is the archive to continue in, or if Pending is set the newest
+	// archive when the pending reports were read. A flush moves the pending
+	// reports to the first archive after it.
+	Archive string `json:"a"`
+	Pending bool   `json:"p"`
+	// Member is the file in the zip to continue in and Skip the number of
+	// reports already read from it. Read holds the number of reports read
+	// from each file before Member, pending files can still grow.
+	Member string         `json:"m,omitempty"`
+	Skip   int            `json:"s"`
+	Read   map[string]int `json:"r,omitempty"`
+	// ID is the last row read with the sqlite store
+	ID int64 `json:"i,omitempty"`
+}
+
+// memberCounter numbers the reports of an archive or the pending reports of
+// a domain file by file
+type memberCounter struct {
+	// resume is the cursor to continue at, nil to read all reports
+	resume *apiCursor
+	member string
+	n      int
+	read   map[string]int
+}
+
+// next returns the position of rec, the next report read, and whether it
+// was already read before c.resume
+func (c *memberCounter) next(rec record, pos apiCursor) (apiCursor, bool) {
+	if rec.Member != c.member {
+		if c.n > 0 {
+			// Copy read since it is shared by the returned positions
+			read := make(map[string]int, len(c.read)+1)
+			for member, n := range c.read {
+				read[member] = n
+			}
+			read[c.member] = c.n
+			c.read = read
+		}
+		c.member, c.n = rec.Member, 0
+	}
+	pos.Member, pos.Skip, pos.Read = c.member, c.n, c.read
+	c.n++
+	if c.resume == nil {
+		return pos, false
+	}
+	switch {
+	case c.member < c.resume.Member:
+		return pos, pos.Skip < c.resume.Read[c.member]
+	case c.member == c.resume.Member:
+		return pos, pos.Skip < c.resume.Skip
+	}
+	return pos, false
+}
+
+func (c apiCursor) String() string {
+	b, _ := json.Marshal(c)
+	return base64.RawURLEncoding.EncodeToString(b)
+}
+
+func parseAPICursor(s string) (c apiCursor, err error) {
+	b, err := base64.RawURLEncoding.DecodeString(s)
+	if err != nil {
+		return c, err
+	}
+	err = json.Unmarshal(b, &c)
+	return c, err
+}
+
+// apiAllowed reports whether req may use the API. Like /get/ requests from
+// the zip page are allowed by their Referer, other tools use HTTP basic auth.
+func apiAllowed(req *http.Request) bool {
+	ref, err := url.Parse(req.Referer())
+	if err == nil && ref.Host == globalConfig.ZipPageURI {
+		return true
+	}
+	return basicAuthAllowed(req, globalConfig.APIUsers) || decryptAllowed(req)
+}
+
+// reportsAPIServer handles requests to /api/reports and streams all stored
+// and pending reports matching the query as JSON:
+// {"reports": [...], "next_cursor": "..."}
+// Query parameters are domain, directive, blocked (part of the blocked URI),
+// from and to (RFC 3339), limit and cursor (next_cursor of the previous
+// page). from and to are rejected for zip archives, which do not save the
+// time of each report. With the sqlite store the reports table is searched.
+// It is served to the zip page and to requests authenticated as one of
+// APIUsers or DecryptUsers, and encrypted archives are only searched if the
+// request is authenticated as one of DecryptUsers.
+func reportsAPIServer(w http.ResponseWriter, req *http.Request) {
+	if req.Method != http.MethodGet {
+		w.Header().Set("Allow", "GET")
+		http.Error(w, "", http.StatusMethodNotAllowed)
+		return
+	}
+	if !apiAllowed(req) {
+		w.Header().Set("WWW-Authenticate", `Basic realm="cspreporter API"`)
+		http.Error(w, "", http.StatusUnauthorized)
+		return
+	}
+	q := req.URL.Query()
+
+	var err error
+	filter := reportFilter{directive: q.Get("directive"), blocked: q.Get("blocked")}
+	if v := q.Get("from"); v != "" {
+		filter.from, err = time.Parse(time.RFC3339, v)
+		if err != nil {
+			http.Error(w, "invalid from", http.StatusBadRequest)
+			return
+		}
+	}
+	if v := q.Get("to"); v != "" {
+		filter.to, err = time.Parse(time.RFC3339, v)
+		if err != nil {
+			http.Error(w, "invalid to", http.StatusBadRequest)
+			return
+		}
+	}
+	sqlite, _ := globalStore.(*sqliteStore)
+	zipArchives := globalConfig.ArchiveFormat == "" || globalConfig.ArchiveFormat == "zip"
+	if sqlite == nil && zipArchives && (!filter.from.IsZero() || !filter.to.IsZero()) {
+		http.Error(w, "from and to need ArchiveFormat jsonl.gz, jsonl.zst or Store sqlite", http.StatusBadRequest)
+		return
+	}
+	limit := defaultAPILimit
+	if v := q.Get("limit"); v != "" {
+		limit, err = strconv.Atoi(v)
+		if err != nil || limit < 1 {
+			http.Error(w, "invalid limit", http.StatusBadRequest)
+			return
+		}
+		if limit > maxAPILimit {
+			limit = maxAPILimit
+		}
+	}
+	var cursor apiCursor
+	if v := q.Get("cursor"); v != "" {
+		cursor, err = parseAPICursor(v)
+		if err != nil {
+			http.Error(w, "invalid cursor", http.StatusBadRequest)
+			return
+		}
+	}
+
+	var domains []string
+	if name := q.Get("domain"); name != "" {
+		if _, ok := globalDomainMap[name]; !ok {
+			http.NotFound(w, req)
+			return
+		}
+		domains = []string{name}
+	} else {
+		for name := range globalDomainMap {
+			domains = append(domains, name)
+		}
+		sort.Strings(domains)
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	w.Write([]byte(`{"reports":[`))
+	flusher, _ := w.(http.Flusher)
+	enc := json.NewEncoder(w)
+
+	n := 0
+	var next *apiCursor
+	// emit writes rec if it matches filter, pos is the position of rec
+	emit := func(domainName string, rec record, pos apiCursor) error {
+		if !filter.match(rec) {
+			return nil
+		}
+		if n == limit {
+			// One more report matches, continue from here on the next page
+			next = &pos
+			return errStopScan
+		}
+		if n > 0 {
+			w.Write([]byte(","))
+		}
+		n++
+		enc.Encode(jsonlRecord{
+			Time:   rec.Time.UTC(),
+			Domain: domainName,
+			Type:   rec.Type,
+			URL:    rec.URL,
+			Report: rec.Report,
+			Body:   rec.Body,
+		})
+		if flusher != nil && n%100 == 0 {
+			flusher.Flush()
+		}
+		return nil
+	}
+
+	if sqlite != nil {
+		err = scanSQLite(sqlite, domains, cursor, filter, limit+1, emit)
+	} else {
+		err = scanDomains(domains, cursor, decryptAllowed(req), emit)
+	}
+	if err != nil && err != errStopScan {
+		log.Println("reportsAPIServer :", err)
+	}
+
+	w.Write([]byte(`],"next_cursor":`))
+	if next != nil {
+		enc.Encode(next.String())
+	} else {
+		enc.Encode(nil)
+	}
+	w.Write([]byte("}"))
+}
+
+// scanDomains calls fn for every report of domains starting at cursor, with
+// the position of each report. Encrypted archives are skipped unless
+// decrypt is set.
+func scanDomains(domains []string, cursor apiCursor, decrypt bool, fn func(domain string, rec record, pos apiCursor) error) error {
+	for _, name := range domains {
+		if name < cursor.Domain {
+			continue
+		}
+		resume := name == cursor.Domain
+
+		// List the archives and copy the pending reports at once so that no
+		// flush can move reports in between
+		d := globalDomainMap[name]
+		d.mutex.Lock()
+		list, err := globalStore.List(name)
+		pending := globalStore.Pending(name)
+		d.mutex.Unlock()
+		if err != nil {
+			return err
+		}
+		sort.Slice(list, func(i, j int) bool { return archiveLess(list[i].FileName, list[j].FileName) })
+		newest := ""
+		if len(list) > 0 {
+			newest = list[len(list)-1].FileName
+		}
+
+		var pendingResume *apiCursor
+		if resume && cursor.Pending {
+			pendingResume = &cursor
+		}
+		for _, archive := range list {
+			members := memberCounter{}
+			switch {
+			case resume && cursor.Pending:
+				if !archiveLess(cursor.Archive, archive.FileName) {
+					continue
+				}
+				// The pending reports of the cursor were flushed to the
+				// first archive after cursor.Archive
+				members.resume, pendingResume = pendingResume, nil
+			case resume:
+				if archiveLess(archive.FileName, cursor.Archive) {
+					continue
+				}
+				if archive.FileName == cursor.Archive {
+					members.resume = &cursor
+				}
+			}
+			if archive.Encrypted && !decrypt {
+				continue
+			}
+			err = globalStore.Records(archive.FileName, func(rec record) error {
+				pos, seen := members.next(rec, apiCursor{Domain: name, Archive: archive.FileName})
+				if seen {
+					return nil
+				}
+				return fn(name, rec, pos)
+			})
+			if err == errStopScan {
+				return err
+			}
+			if err != nil {
+				log.Println("Store.Records() :", archive.FileName, err)
+			}
+		}
+
+		members := memberCounter{resume: pendingResume}
+		err = pending(func(rec record) error {
+			pos, seen := members.next(rec, apiCursor{Domain: name, Archive: newest, Pending: true})
+			if seen {
+				return nil
+			}
+			return fn(name, rec, pos)
+		})
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// scanSQLite calls fn for at most max reports of domains in s matching filter
+// starting at cursor, with the position of each report
+func scanSQLite(s *sqliteStore, domains []string, cursor apiCursor, filter reportFilter, max int, fn func(domain string, rec record, pos apiCursor) error) error {
+	for _, name := range domains {
+		if name < cursor.Domain {
+			continue
+		}
+		var after int64
+		if name == cursor.Domain {
+			after = cursor.ID
+		}
+		ids, records, err := s.Query(name, after, filter, max)
+		if err != nil {
+			return err
+		}
+		for i, rec := range records {
+			err = fn(name, rec, apiCursor{Domain: name, ID: ids[i] - 1})
+			if err != nil {
+				return err
+			}
+		}
+		max -= len(records)
+		if max <= 0 {
+			return nil
+		}
+	}
+	return nil
+}
@@ -2,13 +2,19 @@ package main
 
 import (
 	"bytes"
+	"context"
 	"encoding/json"
 	"flag"
 	"io/ioutil"
 	"log"
 	"net/http"
+	"os"
+	"os/signal"
 	"strings"
+	"sync"
+	"syscall"
 	"text/template"
+	"time"
 )
 
 type configuration struct {
@@ -17,19 +23,86 @@ type configuration struct {
 	DomainsWhitelist []string
 	Syslog           string
 	Transport        string
+	SyslogQueueSize  int
+	SyslogOverflow   string
+	SyslogFormat     string
+	SyslogAppName    string
+	SyslogPEN        int
+	SyslogFraming    string
+	SyslogCAFile     string
+	SyslogCertFile   string
+	SyslogKeyFile    string
+	SyslogServerName string
+	SyslogFacility   string
+	SyslogTag        string
+	SyslogTemplate   string
+	SyslogSeverity   []syslogSeverityRule
 	MaxReportsPerZip int64
+	Rotation         map[string]rotationPolicy
+	Retention        map[string]retentionPolicy
 	ZipsDir          string
+	Store            string
+	ArchiveFormat    string
+	Encryption       string
+	AgeRecipients    []string
+	AgeIdentityFile  string
+	AESKeyFile       string
+	DecryptUsers     map[string]string
+	APIUsers         map[string]string
+	SQLitePath       string
 	TemplateDir      string
 	ZipPageCSPDir    string
 	MaxCSPReportSize int64
 	Silent           bool
+	ShutdownTimeout  int64
+
+	Journal             bool
+	JournalSync         string
+	JournalSyncInterval int64
+
+	// ZipMemberTemplate names the file in the zip for each report, e.g.
+	// {{.Directive}}/{{.Date}}.jsonl
+	ZipMemberTemplate string
+
+	// Dedup saves and sends one record per violation fingerprint every
+	// DedupWindow seconds, with the number of copies received
+	Dedup       bool
+	DedupWindow int64
+
+	// NewViolations alerts on syslog and NewViolationWebhook the first time a
+	// violation is seen
+	NewViolations       bool
+	NewViolationWebhook string
+
+	SpikeAlerts  map[string]spikePolicy
+	SpikeWebhook string
+
+	// SyslogAlertSeverity is the severity of new violation and spike alerts,
+	// it must be above every SyslogSeverity rule
+	SyslogAlertSeverity string
+
+	// MaxAlertsPerHour limits the new violation and spike alerts sent per
+	// domain
+	MaxAlertsPerHour int64
 }
 
 var (
 	globalConfig           configuration
 	globalMainpageTemplate *template.Template
 	globalCSPTemplate      *template.Template
+	globalMemberTemplate   *template.Template
 	globalDomainMap        map[string]*domain
+	globalStore            Store
+	// globalSQLite is the SQLite database of Store sqlite and zip+sqlite
+	globalSQLite *sqliteStore
+	// globalSyslog sends all syslog messages, nil unless Syslog is set
+	globalSyslog         *syslogQueue
+	globalSyslogFacility Priority
+	globalSyslogTemplate *template.Template
+	// globalSyslogAlertSeverity is the parsed SyslogAlertSeverity
+	globalSyslogAlertSeverity Priority
+	// globalWebhookWait tracks webhook requests that are still being sent
+	globalWebhookWait sync.WaitGroup
 )
 
 func main() {
@@ -50,14 +123,70 @@ func main() {
 		http.Handle("/domain/"+domainName+"/", domainServer)
 	}
 
-	// Start cspReportListener in a new go rutinel
-	go cspReportListener()
+	// cspReportListener starts listening in a new go rutine
+	reportServer := cspReportListener()
 
 	http.Handle("/get/", http.HandlerFunc(getZipServer))
 	http.Handle("/del/", http.HandlerFunc(delZipServer))
+	http.Handle("/api/reports", http.HandlerFunc(reportsAPIServer))
+	http.Handle("/api/stats/", http.HandlerFunc(statsAPIServer))
 	http.Handle("/", http.HandlerFunc(mainpageServer))
 
-	log.Fatalln(http.ListenAndServe(globalConfig.ZipPageURI, nil))
+	zipPageServer := &http.Server{Addr: globalConfig.ZipPageURI}
+	go func() {
+		err := zipPageServer.ListenAndServe()
+		if err != http.ErrServerClosed {
+			log.Fatalln(err)
+		}
+	}()
+
+	shutdown(reportServer, zipPageServer)
+}
+
+// shutdown blocks until SIGTERM or SIGINT is received, then stops servers,
+// waits for in-flight reports, syslog messages and webhooks for at most
+// ShutdownTimeout seconds and flushes all domains
+func shutdown(servers ...*http.Server) {
+	signals := make(chan os.Signal, 1)
+	signal.Notify(signals, syscall.SIGTERM, syscall.SIGINT)
+	sig := <-signals
+	if !globalConfig.Silent {
+		log.Println("Received", sig, "shutting down")
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), time.Duration(globalConfig.ShutdownTimeout)*time.Second)
+	defer cancel()
+
+	// Shutdown waits for all active requests, including calls to reportSrv
+	for _, srv := range servers {
+		err := srv.Shutdown(ctx)
+		if err != nil {
+			log.Println("Server.Shutdown() :", err)
+		}
+	}
+
+	webhooksDone := make(chan struct{})
+	go func() {
+		globalWebhookWait.Wait()
+		close(webhooksDone)
+	}()
+	select {
+	case <-webhooksDone:
+	case <-ctx.Done():
+		log.Println("Timed out waiting for webhooks")
+	}
+
+	for _, d := range globalDomainMap {
+		d.flush()
+	}
+
+	// Flushing sends the violations held in dedup mode to syslog as well
+	if globalSyslog != nil {
+		err := globalSyslog.wait(ctx)
+		if err != nil {
+			log.Println("Timed out waiting for syslog messages")
+		}
+	}
 }
 
 // setup reads config from file conf, sets default values and verifies that
@@ -87,6 +216,10 @@ func setup() {
 	if globalConfig.ZipPageURI == "" {
 		log.Fatalln("Invalid config, missing parameter ZipPageURI (DNS adress and port to this servers Zip download page)")
 	}
+	err = checkPasswordHashes("APIUsers", globalConfig.APIUsers)
+	if err != nil {
+		log.Fatalln(err)
+	}
 
 	// Specify default values for non critical config parameters
 	if globalConfig.MaxCSPReportSize == 0 {
@@ -98,12 +231,70 @@ func setup() {
 	if globalConfig.Syslog == "" && !globalConfig.Silent {
 		log.Println("Missing parameter Syslog, inactivating syslog messanges")
 	}
+	switch globalConfig.Transport {
+	case "tcp", "udp", "tls", "unix", "unixgram", "journald":
+	default:
+		log.Fatalln("Invalid config, Transport must be one of tcp, udp, tls, unix, unixgram or journald")
+	}
+	if globalConfig.SyslogQueueSize == 0 {
+		globalConfig.SyslogQueueSize = 10000
+	}
+	if globalConfig.SyslogOverflow == "" {
+		globalConfig.SyslogOverflow = syslogOverflowDropOldest
+	}
+	if globalConfig.SyslogFormat == "" {
+		globalConfig.SyslogFormat = syslogFormatBSD
+	}
+	if globalConfig.SyslogFormat != syslogFormatBSD && globalConfig.SyslogFormat != syslogFormatRFC5424 {
+		log.Fatalln("Invalid config, SyslogFormat must be bsd or rfc5424")
+	}
+	if globalConfig.SyslogAppName == "" {
+		globalConfig.SyslogAppName = "cspreporter"
+	}
+	if globalConfig.SyslogPEN == 0 {
+		globalConfig.SyslogPEN = 32473
+	}
+	switch globalConfig.SyslogOverflow {
+	case syslogOverflowDropOldest, syslogOverflowBlock, syslogOverflowSpill:
+	default:
+		log.Fatalln("Invalid config, SyslogOverflow must be one of drop-oldest, block or spill")
+	}
 	if globalConfig.ZipsDir == "" {
 		if !globalConfig.Silent {
 			log.Println("Missing parameter ZipsDir (where to save and read zip files), defaulting to current directory")
 		}
 		globalConfig.ZipsDir = "./"
 	}
+	for name, policy := range globalConfig.Rotation {
+		switch policy.Interval {
+		case "", "hourly", "daily":
+		default:
+			log.Fatalln("Invalid config, Rotation interval for", name, "must be hourly or daily")
+		}
+	}
+	if globalConfig.ShutdownTimeout == 0 {
+		globalConfig.ShutdownTimeout = 10
+	}
+	if globalConfig.JournalSync == "" {
+		globalConfig.JournalSync = journalSyncInterval
+	}
+	switch globalConfig.JournalSync {
+	case journalSyncAlways, journalSyncInterval, journalSyncNever:
+	default:
+		log.Fatalln("Invalid config, JournalSync must be one of always, interval or never")
+	}
+	if globalConfig.JournalSyncInterval == 0 {
+		globalConfig.JournalSyncInterval = 1000
+	}
+	if globalConfig.DedupWindow == 0 {
+		globalConfig.DedupWindow = 300
+	}
+	if globalConfig.MaxAlertsPerHour == 0 {
+		globalConfig.MaxAlertsPerHour = 60
+	}
+	if globalConfig.NewViolationWebhook != "" || globalConfig.SpikeWebhook != "" {
+		go sendWebhooks()
+	}
 	if globalConfig.TemplateDir == "" && !globalConfig.Silent {
 		log.Println("Missing parameter TemplateDir, defaulting to current directory")
 		globalConfig.TemplateDir = "./"
@@ -117,6 +308,67 @@ func setup() {
 		globalConfig.ZipsDir += "/"
 	}
 
+	err = setupEncryption()
+	if err != nil {
+		log.Fatalln(err)
+	}
+
+	if globalConfig.Syslog != "" {
+		err = setupSyslogMessages()
+		if err != nil {
+			log.Fatalln(err)
+		}
+		opts, err := syslogDialOptions()
+		if err != nil {
+			log.Fatalln(err)
+		}
+		globalSyslog, err = newSyslogQueue(globalConfig.Transport, globalConfig.Syslog, opts, globalConfig.SyslogQueueSize, globalConfig.SyslogOverflow, globalConfig.ZipsDir+"syslog.spill")
+		if err != nil {
+			log.Fatalln(err)
+		}
+	}
+
+	var archives Store
+	switch globalConfig.ArchiveFormat {
+	case "", "zip":
+		archives = newZipStore(globalConfig.ZipsDir)
+	case "jsonl.gz", "jsonl.zst":
+		archives = newJSONLStore(globalConfig.ZipsDir, globalConfig.ArchiveFormat)
+	default:
+		log.Fatalln("Invalid config, ArchiveFormat must be one of zip, jsonl.gz or jsonl.zst")
+	}
+	switch globalConfig.Store {
+	case "", "zip":
+		globalStore = archives
+	case "sqlite", "zip+sqlite":
+		if globalConfig.SQLitePath == "" {
+			globalConfig.SQLitePath = globalConfig.ZipsDir + "cspreporter.db"
+		}
+		if globalConfig.Encryption != "" && inDir(globalConfig.SQLitePath, globalConfig.ZipsDir) {
+			log.Fatalln("Invalid config, Encryption does not encrypt SQLite, set SQLitePath outside of ZipsDir")
+		}
+		sqlite, err := newSQLiteStore(globalConfig.SQLitePath)
+		if err != nil {
+			log.Fatalln(err)
+		}
+		if globalConfig.Store == "sqlite" {
+			globalStore = sqlite
+		} else {
+			globalStore = multiStore{archives, sqlite}
+		}
+		globalSQLite = sqlite
+	default:
+		log.Fatalln("Invalid config, Store must be one of zip, sqlite or zip+sqlite")
+	}
+	for name, policy := range globalConfig.Retention {
+		if policy.MaxArchives > 0 && globalConfig.Store == "sqlite" {
+			log.Fatalln("Invalid config, Retention", name, "MaxArchives needs archives, use MaxRows with Store sqlite")
+		}
+		if policy.MaxRows > 0 && globalSQLite == nil {
+			log.Fatalln("Invalid config, Retention", name, "MaxRows needs Store sqlite or zip+sqlite")
+		}
+	}
+
 	// Populate globalCSPTemplate eather from defaultCSPTemplate or from the
 	// csp.tmpl file
 	defaultCSPTemplate := "default-src 'none'; script-src 'nonce-{{.}}; style-src 'none'; media-src 'none'; img-src 'self' data:; child-src 'none'; frame-src 'none'; frame-ancestors 'none'; object-src 'none'; base-uri 'none'; font-src 'none'; connect-src 'none'; report-uri https://{{.}}/csp;"
@@ -128,4 +380,14 @@ func setup() {
 	globalCSPTemplate = template.Must(template.New("csp").Parse(cspTemplate))
 
 	globalMainpageTemplate = template.Must(template.ParseFiles(globalConfig.TemplateDir + "index.tmpl"))
+
+	if globalConfig.ZipMemberTemplate != "" {
+		globalMemberTemplate, err = template.New("member").Parse(globalConfig.ZipMemberTemplate)
+		if err == nil {
+			err = checkMemberTemplate()
+		}
+		if err != nil {
+			log.Fatalln("Invalid config, ZipMemberTemplate :", err)
+		}
+	}
 }
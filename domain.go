@@ -1,28 +1,55 @@
 package main
 
 import (
-	"archive/zip"
-	"bytes"
-	"io"
-	"io/ioutil"
 	"log"
 	"net/http"
 	"net/url"
-	"os"
-	"strconv"
 	"sync"
 	"time"
 )
 
 type domain struct {
 	name      string
-	zipData   *bytes.Buffer
-	zipWriter *zip.Writer
-	textInZip io.Writer
 	mutex     sync.Mutex
 	nr        int64
-	fileNr    int
 	lastFlush time.Time
+	journal   *journal
+	// oldest is when the oldest pending report arrived
+	oldest   time.Time
+	rotation rotationPolicy
+
+	// Network Error Logging reports counted by error type and server IP
+	nelByType     counter
+	nelByServerIP counter
+
+	// Trusted Types violations counted by sink
+	trustedTypesSinks counter
+
+	// CSP violations counted over the last week
+	stats *rollingStats
+
+	// CSP violations counted by fingerprint, and in dedup mode the
+	// violations held back until the end of the window
+	fingerprints fingerprints
+	dedup        map[string]*pendingDedup
+	// held counts the violations journaled and held since the last flush
+	held int64
+
+	// Fingerprints of the violations seen in seenViolationMaxAge, nil unless
+	// NewViolations
+	seen *seenViolations
+
+	// Report rates checked for spikes, nil unless SpikeAlerts has a policy
+	// for the domain
+	rates *rateTracker
+
+	// Limits the new violation and spike alerts sent
+	alerts alertLimiter
+
+	// Syslog messages queued while d.mutex is held, sent in order under
+	// syslogMutex once it is released
+	syslogOut   []syslogMessage
+	syslogMutex sync.Mutex
 }
 
 // newDomain returns a new *domain with domain.Name set to name
@@ -31,19 +58,65 @@ func newDomain(name string) *domain {
 	d.mutex.Lock()
 	defer d.mutex.Unlock()
 
-	d.zipData = new(bytes.Buffer)
 	d.name = name
-	// Create a new zip archive.
-	d.zipWriter = zip.NewWriter(d.zipData)
+	d.nelByType = make(counter)
+	d.nelByServerIP = make(counter)
+	d.trustedTypesSinks = make(counter)
+	d.stats = newRollingStats()
+	d.fingerprints = make(fingerprints)
+	d.dedup = make(map[string]*pendingDedup)
+
+	if globalConfig.Journal {
+		j, reports, err := openJournal(globalConfig.ZipsDir + d.name + ".journal")
+		if err != nil {
+			log.Fatal(err)
+		}
+		d.journal = j
+		// Replay reports that were not flushed before the last shutdown
+		for _, body := range reports {
+			records, err := parseStoredReports(body)
+			if err != nil {
+				continue // Skip if errors
+			}
+			for _, rec := range records {
+				rec.Replayed = true
+				d.replay(rec)
+			}
+		}
+		if globalConfig.JournalSync == journalSyncInterval {
+			go d.syncJournal()
+		}
+	}
 
-	f, err := d.zipWriter.Create(d.name + ".txt")
-	if err != nil {
-		log.Fatal(err)
+	if globalConfig.NewViolations {
+		s, err := openSeenViolations(globalConfig.ZipsDir + d.name + ".seen")
+		if err != nil {
+			log.Fatal(err)
+		}
+		d.seen = s
+	}
+
+	d.rotation = rotationPolicyFor(name)
+	if d.rotation.Interval != "" || d.rotation.MaxAge > 0 {
+		go d.rotateOnSchedule(d.rotation)
+	}
+
+	retention := retentionPolicyFor(name)
+	if retention.MaxAgeDays > 0 || retention.MaxBytes > 0 || retention.MaxArchives > 0 {
+		go d.enforceRetention(retention)
+	}
+
+	if globalConfig.Dedup {
+		go d.dedupOnSchedule()
 	}
 
-	d.textInZip = f
+	spikes := spikePolicyFor(name)
+	if spikes.MaxRate > 0 || spikes.Deviation > 0 {
+		d.rates = newRateTracker()
+		go d.checkSpikes(spikes)
+	}
 
-	go d.resetFileNr()
+	go d.flushStale()
 
 	return d
 }
@@ -63,60 +136,53 @@ func (d *domain) ServeHTTP(w http.ResponseWriter, req *http.Request) {
 	}
 }
 
-// resetFileNr resets d.fileNr every day at 00:00 and flush all CSP reports if
-// no flush has happened in the last 30 days.
-// Note that resetFileNr will not return so call it in a new gorutine.
-func (d *domain) resetFileNr() {
+// flushStale flushes all reports every day at 00:00 if no flush has happened
+// in the last 30 days, forgets fingerprints not seen in 30 days and new
+// violation fingerprints not seen in seenViolationMaxAge.
+// Note that flushStale will not return so call it in a new gorutine.
+func (d *domain) flushStale() {
 	newDay := time.Now().Add(time.Hour * 24).Truncate(time.Hour * 24)
 	time.Sleep(time.Until(newDay))
 
 	ticker := time.NewTicker(time.Hour * 24)
 	for range ticker.C {
 		d.mutex.Lock()
-		d.fileNr = 0
-		if time.Since(d.lastFlush) > time.Hour*24*30 {
-			d.flush()
+		stale := time.Since(d.lastFlush) > time.Hour*24*30
+		d.fingerprints.prune(time.Now())
+		if d.seen != nil {
+			err := d.seen.prune(time.Now())
+			if err != nil {
+				log.Println("seenViolations.prune() :", err)
+			}
 		}
 		d.mutex.Unlock()
+		if stale {
+			d.flush()
+		}
 	}
 }
 
-// flush writes all csp reports related to d to the current .zip file, if no
-// .zip file exsists then a new .zip file is created
+// flush moves all reports related to d, including violations held in dedup
+// mode, into a new archive in globalStore
 func (d *domain) flush() {
+	defer d.sendQueuedSyslog()
 	d.mutex.Lock()
 	defer d.mutex.Unlock()
+	d.emitDedup()
 	if d.nr > 0 {
-		// Close Zip file
-		err := d.zipWriter.Close()
+		err := globalStore.Rotate(d.name)
 		if err != nil {
-			log.Println("ZipWriter.Close() :", err)
+			log.Println("Store.Rotate() :", err)
 			return
 		}
-		// Zip file name as: example.com_YYYY-MMM-DD_i.zip
-		zipName := globalConfig.ZipsDir + d.name + "_" + time.Now().Format("2006-01-02") + "_" + strconv.Itoa(d.fileNr) + ".zip"
-		for _, err = os.Stat(zipName); !os.IsNotExist(err); d.fileNr++ {
-			zipName = globalConfig.ZipsDir + d.name + "_" + time.Now().Format("2006-01-02") + "_" + strconv.Itoa(d.fileNr) + ".zip"
-			_, err = os.Stat(zipName)
-		}
-
-		err = ioutil.WriteFile(zipName, d.zipData.Bytes(), 0644)
-		if err != nil {
-			log.Println("ioutil.WriteFile() :", err)
-			return
-		}
-		// Empty the buffer
-		d.zipData.Reset()
-
-		d.zipWriter = zip.NewWriter(d.zipData)
-
-		// Create file in zip archive.
-		f, err := d.zipWriter.Create(d.name + ".txt")
-		if err != nil {
-			log.Println("ZipWriter.Create() :", err)
+		if d.journal != nil {
+			err = d.journal.truncate()
+			if err != nil {
+				log.Println("journal.truncate() :", err)
+			}
 		}
-		d.textInZip = f
 		d.nr = 0
+		d.held = 0
 		d.lastFlush = time.Now()
 	}
 }
@@ -0,0 +1,216 @@
+package main
+
+import (
+	"bytes"
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/rand"
+	"encoding/base64"
+	"errors"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"os"
+	"strings"
+
+	"filippo.io/age"
+)
+
+// Extensions added to the names of encrypted archives
+const (
+	ageExt    = ".age"
+	aesGCMExt = ".enc"
+)
+
+var (
+	globalAgeRecipients []age.Recipient
+	globalAgeIdentities []age.Identity
+	globalAESGCM        cipher.AEAD
+)
+
+// setupEncryption loads the keys used to encrypt and decrypt archives
+func setupEncryption() error {
+	switch globalConfig.Encryption {
+	case "":
+	case "age":
+		if len(globalConfig.AgeRecipients) == 0 {
+			return errors.New("Invalid config, Encryption age needs at least one key in AgeRecipients")
+		}
+		for _, key := range globalConfig.AgeRecipients {
+			r, err := age.ParseX25519Recipient(key)
+			if err != nil {
+				return err
+			}
+			globalAgeRecipients = append(globalAgeRecipients, r)
+		}
+		// The journal, spill and seen files are encrypted line by line and
+		// read back on startup
+		if globalConfig.AgeIdentityFile == "" && (globalConfig.Journal || globalConfig.SyslogOverflow == syslogOverflowSpill || globalConfig.NewViolations) {
+			return errors.New("Invalid config, Encryption age with Journal, SyslogOverflow spill or NewViolations needs AgeIdentityFile")
+		}
+	case "aes-gcm":
+		if globalConfig.AESKeyFile == "" {
+			return errors.New("Invalid config, Encryption aes-gcm needs AESKeyFile")
+		}
+	default:
+		return errors.New("Invalid config, Encryption must be age or aes-gcm")
+	}
+
+	err := checkPasswordHashes("DecryptUsers", globalConfig.DecryptUsers)
+	if err != nil {
+		return err
+	}
+
+	// The AES key is used both to encrypt and decrypt, the age identities
+	// only to decrypt archives on download
+	if globalConfig.AESKeyFile != "" {
+		data, err := ioutil.ReadFile(globalConfig.AESKeyFile)
+		if err != nil {
+			return err
+		}
+		key, err := base64.StdEncoding.DecodeString(strings.TrimSpace(string(data)))
+		if err != nil {
+			return err
+		}
+		if len(key) != 32 {
+			return errors.New("AESKeyFile must hold a base64 encoded 256 bit key")
+		}
+		block, err := aes.NewCipher(key)
+		if err != nil {
+			return err
+		}
+		globalAESGCM, err = cipher.NewGCM(block)
+		if err != nil {
+			return err
+		}
+	}
+	if globalConfig.AgeIdentityFile != "" {
+		f, err := os.Open(globalConfig.AgeIdentityFile)
+		if err != nil {
+			return err
+		}
+		defer f.Close()
+		globalAgeIdentities, err = age.ParseIdentities(f)
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// encryptArchive encrypts data with the configured Encryption and returns
+// the extension to add to the archive name
+func encryptArchive(data []byte) (encrypted []byte, ext string, err error) {
+	switch globalConfig.Encryption {
+	case "age":
+		var buf bytes.Buffer
+		w, err := age.Encrypt(&buf, globalAgeRecipients...)
+		if err != nil {
+			return nil, "", err
+		}
+		_, err = w.Write(data)
+		if err != nil {
+			return nil, "", err
+		}
+		err = w.Close()
+		if err != nil {
+			return nil, "", err
+		}
+		return buf.Bytes(), ageExt, nil
+	case "aes-gcm":
+		// The nonce is saved in front of the ciphertext
+		nonce := make([]byte, globalAESGCM.NonceSize())
+		_, err = rand.Read(nonce)
+		if err != nil {
+			return nil, "", err
+		}
+		return globalAESGCM.Seal(nonce, nonce, data, nil), aesGCMExt, nil
+	}
+	return data, "", nil
+}
+
+// encryptLine encrypts one line of a journal, spill or seen file in ZipsDir
+// with the configured Encryption, base64 encoded so that it stays one line
+func encryptLine(line []byte) ([]byte, error) {
+	data, ext, err := encryptArchive(line)
+	if err != nil || ext == "" {
+		return data, err
+	}
+	encoded := make([]byte, base64.StdEncoding.EncodedLen(len(data)))
+	base64.StdEncoding.Encode(encoded, data)
+	return encoded, nil
+}
+
+// decryptLine decrypts a line written by encryptLine
+func decryptLine(line []byte) ([]byte, error) {
+	var ext string
+	switch globalConfig.Encryption {
+	case "age":
+		ext = ageExt
+	case "aes-gcm":
+		ext = aesGCMExt
+	default:
+		return line, nil
+	}
+	data := make([]byte, base64.StdEncoding.DecodedLen(len(line)))
+	n, err := base64.StdEncoding.Decode(data, line)
+	if err != nil {
+		return nil, err
+	}
+	plain, _, err := decryptArchive(ext, bytes.NewReader(data[:n]))
+	return plain, err
+}
+
+// maxEncryptedLineSize is the longest line encryptLine returns for a line of
+// at most size bytes
+func maxEncryptedLineSize(size int) int {
+	if globalConfig.Encryption == "" {
+		return size
+	}
+	// age adds a header of a few hundred bytes and 16 bytes every 64 KiB,
+	// aes-gcm a nonce and a tag
+	return base64.StdEncoding.EncodedLen(size + size/65536*16 + 4096)
+}
+
+// isEncrypted reports whether name is an encrypted archive
+func isEncrypted(name string) bool {
+	return strings.HasSuffix(name, ageExt) || strings.HasSuffix(name, aesGCMExt)
+}
+
+// decryptArchive decrypts the archive name, it returns the plaintext and the
+// name without the encryption extension
+func decryptArchive(name string, r io.Reader) (plain []byte, plainName string, err error) {
+	switch {
+	case strings.HasSuffix(name, ageExt):
+		if len(globalAgeIdentities) == 0 {
+			return nil, "", errors.New("no AgeIdentityFile to decrypt " + name)
+		}
+		dr, err := age.Decrypt(r, globalAgeIdentities...)
+		if err != nil {
+			return nil, "", err
+		}
+		plain, err = ioutil.ReadAll(dr)
+		return plain, strings.TrimSuffix(name, ageExt), err
+	case strings.HasSuffix(name, aesGCMExt):
+		if globalAESGCM == nil {
+			return nil, "", errors.New("no AESKeyFile to decrypt " + name)
+		}
+		data, err := ioutil.ReadAll(r)
+		if err != nil {
+			return nil, "", err
+		}
+		if len(data) < globalAESGCM.NonceSize() {
+			return nil, "", errors.New("encrypted archive is too short")
+		}
+		nonce, ciphertext := data[:globalAESGCM.NonceSize()], data[globalAESGCM.NonceSize():]
+		plain, err = globalAESGCM.Open(nil, nonce, ciphertext, nil)
+		return plain, strings.TrimSuffix(name, aesGCMExt), err
+	}
+	return nil, "", errNotArchive
+}
+
+// decryptAllowed checks the HTTP basic auth credentials of req against
+// DecryptUsers, where passwords are saved as bcrypt hashes
+func decryptAllowed(req *http.Request) bool {
+	return basicAuthAllowed(req, globalConfig.DecryptUsers)
+}
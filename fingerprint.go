@@ -0,0 +1,244 @@
+package main
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"log"
+	"net/url"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+)
+
+const (
+	// maxFingerprints limits the number of fingerprints kept per domain,
+	// violations with new fingerprints are not tracked once it is reached
+	maxFingerprints = 10000
+	// fingerprintMaxAge is how long a fingerprint is kept after it was last
+	// seen
+	fingerprintMaxAge = 30 * 24 * time.Hour
+)
+
+// violationKey holds the normalized fields of a report that identify a
+// violation, regardless of query strings and the browser that sent it
+type violationKey struct {
+	DocumentPath  string `json:"document-path"`
+	Directive     string `json:"directive"`
+	BlockedOrigin string `json:"blocked-origin"`
+	SourceFile    string `json:"source-file"`
+	LineNumber    int    `json:"line-number"`
+}
+
+// newViolationKey returns the normalized violationKey of r
+func newViolationKey(r *report) violationKey {
+	k := violationKey{
+		BlockedOrigin: strings.ToLower(uriOrigin(r.BlockedURI)),
+		SourceFile:    stripQuery(r.SourceFile),
+		LineNumber:    r.LineNumber,
+	}
+	if u, err := url.Parse(r.DocumentURI); err == nil {
+		k.DocumentPath = u.Path
+	}
+	// Older browsers send the whole directive, e.g. "script-src 'self'"
+	directive := r.EffectiveDirective
+	if directive == "" {
+		directive = r.ViolatedDirective
+	}
+	if fields := strings.Fields(directive); len(fields) > 0 {
+		k.Directive = strings.ToLower(fields[0])
+	}
+	return k
+}
+
+// stripQuery returns uri without query and fragment
+func stripQuery(uri string) string {
+	if i := strings.IndexAny(uri, "?#"); i >= 0 {
+		return uri[:i]
+	}
+	return uri
+}
+
+// fingerprint returns a hex encoded hash of k
+func (k violationKey) fingerprint() string {
+	h := sha256.New()
+	for _, field := range []string{k.DocumentPath, k.Directive, k.BlockedOrigin, k.SourceFile, strconv.Itoa(k.LineNumber)} {
+		h.Write([]byte(field))
+		h.Write([]byte{0})
+	}
+	return hex.EncodeToString(h.Sum(nil)[:16])
+}
+
+// fingerprintEntry counts the violations with the same fingerprint
+type fingerprintEntry struct {
+	violationKey
+	Fingerprint string
+	FirstSeen   time.Time
+	LastSeen    time.Time
+	Count       int64
+}
+
+// fingerprints holds the fingerprintEntry of every violation of a domain
+type fingerprints map[string]*fingerprintEntry
+
+// seen counts a violation with key k at t and returns its fingerprint
+func (f fingerprints) seen(k violationKey, t time.Time) string {
+	fp := k.fingerprint()
+	e, ok := f[fp]
+	if !ok {
+		if len(f) >= maxFingerprints {
+			return fp
+		}
+		e = &fingerprintEntry{violationKey: k, Fingerprint: fp, FirstSeen: t}
+		f[fp] = e
+	}
+	e.LastSeen = t
+	e.Count++
+	return fp
+}
+
+// prune removes fingerprints not seen since fingerprintMaxAge
+func (f fingerprints) prune(now time.Time) {
+	for fp, e := range f {
+		if now.Sub(e.LastSeen) > fingerprintMaxAge {
+			delete(f, fp)
+		}
+	}
+}
+
+// top returns the n most common fingerprints
+func (f fingerprints) top(n int) []fingerprintEntry {
+	entries := make([]fingerprintEntry, 0, len(f))
+	for _, e := range f {
+		entries = append(entries, *e)
+	}
+	sort.Slice(entries, func(i, j int) bool {
+		if entries[i].Count != entries[j].Count {
+			return entries[i].Count > entries[j].Count
+		}
+		return entries[i].Fingerprint < entries[j].Fingerprint
+	})
+	if len(entries) > n {
+		entries = entries[:n]
+	}
+	return entries
+}
+
+// dedupReport is saved and sent to syslog once per fingerprint and
+// DedupWindow in dedup mode, instead of every copy of the violation
+type dedupReport struct {
+	Report      *report   `json:"csp-report"`
+	Fingerprint string    `json:"fingerprint"`
+	Count       int64     `json:"count"`
+	FirstSeen   time.Time `json:"first-seen"`
+	LastSeen    time.Time `json:"last-seen"`
+}
+
+// pendingDedup is a violation held back in dedup mode until the end of the
+// window
+type pendingDedup struct {
+	rec   record
+	dedup dedupReport
+}
+
+// parseDedupReport returns the dedupReport in body, or nil if body is not
+// one
+func parseDedupReport(body []byte) *dedupReport {
+	var dr dedupReport
+	if json.Unmarshal(body, &dr) != nil || dr.Fingerprint == "" {
+		return nil
+	}
+	return &dr
+}
+
+// parseStoredReports decodes body read back from a journal, archive or the
+// reports table like parseReports, and also the dedupReports saved in dedup
+// mode. It must not be used for reports received from clients.
+func parseStoredReports(body []byte) ([]record, error) {
+	records, err := parseReports("", body)
+	if err != nil {
+		return nil, err
+	}
+	if len(records) == 1 && records[0].Type == reportTypeCSP && bytes.Contains(body, []byte(`"fingerprint"`)) {
+		if dr := parseDedupReport(body); dr != nil {
+			records[0].Body = dr
+			records[0].Time = dr.LastSeen
+		}
+	}
+	return records, nil
+}
+
+// hold counts rec, a CSP violation with fingerprint fp, in the current dedup
+// window of d.
+// It must be called with d.mutex held.
+func (d *domain) hold(rec record, fp string) {
+	p, ok := d.dedup[fp]
+	if !ok {
+		p = &pendingDedup{rec: rec, dedup: dedupReport{Report: rec.Report, Fingerprint: fp, FirstSeen: rec.Time}}
+		d.dedup[fp] = p
+	}
+	p.dedup.Count++
+	p.dedup.LastSeen = rec.Time
+	d.held++
+}
+
+// replay adds rec read back from the journal to d. In dedup mode CSP
+// violations are held again, until a dedup record shows that the window of
+// their fingerprint was already emitted.
+// It must be called with d.mutex held.
+func (d *domain) replay(rec record) {
+	if globalConfig.Dedup && rec.Report != nil {
+		dr, ok := rec.Body.(*dedupReport)
+		if !ok {
+			d.hold(rec, newViolationKey(rec.Report).fingerprint())
+			return
+		}
+		delete(d.dedup, dr.Fingerprint)
+	}
+	d.store(rec)
+}
+
+// emitDedup saves and sends one record per fingerprint held in the current
+// dedup window of d and starts a new window. The dedup records are journaled
+// after the violations they count, which replay then skips.
+// It must be called with d.mutex held.
+func (d *domain) emitDedup() {
+	for fp, p := range d.dedup {
+		raw, err := json.Marshal(p.dedup)
+		if err != nil {
+			log.Println("json.Marshal() :", err)
+			continue
+		}
+		dr := p.dedup
+		rec := p.rec
+		rec.Raw = raw
+		rec.Body = &dr
+		rec.Time = dr.LastSeen
+		// Held violations may be replayed, the dedup record is new
+		rec.Replayed = false
+		err = d.commit(rec)
+		if err != nil {
+			log.Println("domain.commit() :", err)
+		}
+		delete(d.dedup, fp)
+	}
+}
+
+// dedupOnSchedule emits the violations held in dedup mode every DedupWindow
+// seconds.
+// Note that dedupOnSchedule will not return so call it in a new gorutine.
+func (d *domain) dedupOnSchedule() {
+	ticker := time.NewTicker(time.Duration(globalConfig.DedupWindow) * time.Second)
+	for range ticker.C {
+		d.mutex.Lock()
+		d.emitDedup()
+		full := d.full()
+		d.mutex.Unlock()
+		d.sendQueuedSyslog()
+		if full {
+			d.flush()
+		}
+	}
+}
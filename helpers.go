@@ -4,10 +4,15 @@ import (
 	"bytes"
 	"crypto/rand"
 	"encoding/base64"
+	"errors"
 	"fmt"
-	"io/ioutil"
+	"net/http"
 	"path/filepath"
+	"sort"
 	"strings"
+	"time"
+
+	"golang.org/x/crypto/bcrypt"
 )
 
 func getCSP() (nonce, csp string, err error) {
@@ -30,27 +35,43 @@ func getCSP() (nonce, csp string, err error) {
 	return nonce, tpl.String(), nil
 }
 
-type zipInfo struct {
-	FileName string
-	Size     string
+// counter counts how many times each key has been seen
+type counter map[string]int64
+
+func (c counter) add(key string) {
+	c[key]++
 }
 
-// getZipList returns a list of all .zip files in the globalConfig.ZipsDir
-// directory that start with the prefix domain
-func getZipList(domain string) (list []zipInfo, err error) {
-	files, err := ioutil.ReadDir(globalConfig.ZipsDir)
-	if err != nil {
-		return nil, err
-	}
+type keyCount struct {
+	Key   string `json:"key"`
+	Count int64  `json:"count"`
+}
 
-	for _, file := range files {
-		// Only list files that has .zip extention and start with the specified
-		// domain name.
-		if filepath.Ext(file.Name()) == ".zip" && strings.HasPrefix(file.Name(), domain) {
-			list = append(list, zipInfo{FileName: file.Name(), Size: readableSize(file.Size())})
+// top returns at most max keys in c, the most seen key first
+func (c counter) top(max int) []keyCount {
+	list := make([]keyCount, 0, len(c))
+	for key, count := range c {
+		list = append(list, keyCount{Key: key, Count: count})
+	}
+	sort.Slice(list, func(i, j int) bool {
+		if list[i].Count != list[j].Count {
+			return list[i].Count > list[j].Count
 		}
+		return list[i].Key < list[j].Key
+	})
+	if len(list) > max {
+		list = list[:max]
 	}
-	return
+	return list
+}
+
+type zipInfo struct {
+	FileName string
+	Size     string
+	Bytes    int64
+	ModTime  time.Time
+	// Encrypted archives can be decrypted on download by DecryptUsers
+	Encrypted bool
 }
 
 func fileNameFromURL(path string) string {
@@ -81,6 +102,27 @@ func fileNameFromURL(path string) string {
 	return string(file)
 }
 
+// cleanMemberField removes all characters but A-Z, a-z, 0-9, "-", "_" and "."
+// from s and any leading ".", so that report fields can be used in the names
+// of files in a zip
+func cleanMemberField(s string) string {
+	field := make([]byte, 0, len(s))
+	for _, v := range s {
+		switch {
+		case v >= '0' && v <= '9',
+			v >= 'A' && v <= 'Z',
+			v >= 'a' && v <= 'z',
+			v == '-', v == '_', v == '.':
+			field = append(field, byte(v))
+		}
+	}
+	cleaned := strings.TrimLeft(string(field), ".")
+	if cleaned == "" {
+		return "none"
+	}
+	return cleaned
+}
+
 func readableSize(b int64) string {
 	switch {
 	case b > 1024*1024*1024:
@@ -93,3 +135,43 @@ func readableSize(b int64) string {
 		return fmt.Sprintf("%d bytes", b)
 	}
 }
+
+// inDir reports whether path is inside dir
+func inDir(path, dir string) bool {
+	path, err := filepath.Abs(path)
+	if err != nil {
+		return false
+	}
+	dir, err = filepath.Abs(dir)
+	if err != nil {
+		return false
+	}
+	rel, err := filepath.Rel(dir, path)
+	return err == nil && rel != ".." && !strings.HasPrefix(rel, "../")
+}
+
+// basicAuthAllowed checks the HTTP basic auth credentials of req against
+// users, which maps user names to bcrypt hashes of their passwords
+func basicAuthAllowed(req *http.Request, users map[string]string) bool {
+	user, password, ok := req.BasicAuth()
+	if !ok {
+		return false
+	}
+	hash, ok := users[user]
+	if !ok {
+		return false
+	}
+	return bcrypt.CompareHashAndPassword([]byte(hash), []byte(password)) == nil
+}
+
+// checkPasswordHashes returns an error unless every password in users, set
+// in the config parameter name, is a bcrypt hash
+func checkPasswordHashes(name string, users map[string]string) error {
+	for user, hash := range users {
+		_, err := bcrypt.Cost([]byte(hash))
+		if err != nil {
+			return errors.New("Invalid config, " + name + " " + user + " needs a bcrypt hash of the password : " + err.Error())
+		}
+	}
+	return nil
+}
@@ -0,0 +1,190 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/json"
+	"errors"
+	"io"
+	"log"
+	"os"
+	"time"
+)
+
+// Values for the JournalSync config parameter
+const (
+	journalSyncAlways   = "always"
+	journalSyncInterval = "interval"
+	journalSyncNever    = "never"
+)
+
+// journal is an append-only file in ZipsDir holding every report written to
+// a domain since its last flush, one compact JSON report per line, encrypted
+// with encryptLine if Encryption is set. It is replayed into the domain on
+// startup so that pending reports survive crashes and restarts.
+type journal struct {
+	file  *os.File
+	dirty bool
+	// size is the number of bytes in file
+	size int64
+}
+
+// openJournal opens or creates the journal at path and returns it together
+// with the reports it already holds
+func openJournal(path string) (j *journal, reports [][]byte, err error) {
+	f, err := os.OpenFile(path, os.O_RDWR|os.O_CREATE|os.O_APPEND, 0644)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	end, skipped, err := readLines(f, maxEncryptedLineSize(int(globalConfig.MaxCSPReportSize)), func(b []byte) {
+		line, err := decryptLine(b)
+		if err != nil {
+			log.Println("journal", path, ":", err)
+			return // Skip if errors
+		}
+		reports = append(reports, append([]byte(nil), line...))
+	})
+	if err != nil {
+		f.Close()
+		return nil, nil, err
+	}
+	if skipped > 0 {
+		// A line that is too long can only be a broken write
+		log.Println("journal", path, ": skipped", skipped, "lines that are too long")
+	}
+	err = dropTornLine(f, end)
+	if err == errTornLine {
+		log.Println("journal", path, ":", err)
+	} else if err != nil {
+		f.Close()
+		return nil, nil, err
+	}
+
+	return &journal{file: f, size: end}, reports, nil
+}
+
+// errTornLine is returned by dropTornLine when it removed a torn line
+var errTornLine = errors.New("removed a torn line after the last newline")
+
+// dropTornLine truncates f to end, the offset after its last newline as
+// returned by readLines, so that the next line appended to f does not join
+// a torn last write
+func dropTornLine(f *os.File, end int64) error {
+	size, err := f.Seek(0, io.SeekEnd)
+	if err != nil {
+		return err
+	}
+	if size == end {
+		return nil
+	}
+	err = f.Truncate(end)
+	if err != nil {
+		return err
+	}
+	return errTornLine
+}
+
+// readLines calls fn with every line read from r, without the newline. Lines
+// longer than max bytes are skipped and counted in skipped. End is the offset
+// after the last newline in r, any bytes after it are a torn line that is not
+// passed to fn. The slice passed to fn is only valid during the call.
+func readLines(r io.Reader, max int, fn func(line []byte)) (end int64, skipped int, err error) {
+	reader := bufio.NewReader(r)
+	var line []byte
+	var n int64
+	tooLong := false
+	for {
+		chunk, err := reader.ReadSlice('\n')
+		n += int64(len(chunk))
+		if !tooLong {
+			line = append(line, chunk...)
+			if len(line) > max+1 {
+				// Drop what is read so far and discard the rest of the line
+				tooLong = true
+				line = line[:0]
+			}
+		}
+		switch err {
+		case nil:
+			end = n
+			if tooLong {
+				skipped++
+			} else {
+				fn(line[:len(line)-1])
+			}
+			line = line[:0]
+			tooLong = false
+		case bufio.ErrBufferFull:
+			// The line continues in the next chunk
+		case io.EOF:
+			return end, skipped, nil
+		default:
+			return end, skipped, err
+		}
+	}
+}
+
+// append writes body to the end of j and syncs it to disk if JournalSync is
+// "always"
+func (j *journal) append(body []byte) error {
+	var line bytes.Buffer
+	err := json.Compact(&line, body)
+	if err != nil {
+		return err
+	}
+	b, err := encryptLine(line.Bytes())
+	if err != nil {
+		return err
+	}
+
+	n, err := j.file.Write(append(b, '\n'))
+	j.size += int64(n)
+	if err != nil {
+		return err
+	}
+	j.dirty = true
+	if globalConfig.JournalSync == journalSyncAlways {
+		return j.sync()
+	}
+	return nil
+}
+
+// sync commits all writes to j to disk
+func (j *journal) sync() error {
+	if !j.dirty {
+		return nil
+	}
+	j.dirty = false
+	return j.file.Sync()
+}
+
+// truncate removes all reports from j, call it when they have been saved in a
+// zip
+func (j *journal) truncate() error {
+	err := j.file.Truncate(0)
+	if err != nil {
+		return err
+	}
+	j.size = 0
+	_, err = j.file.Seek(0, io.SeekStart)
+	if err != nil {
+		return err
+	}
+	j.dirty = true
+	return j.sync()
+}
+
+// syncJournal syncs d.journal to disk every JournalSyncInterval milliseconds.
+// Note that syncJournal will not return so call it in a new gorutine.
+func (d *domain) syncJournal() {
+	ticker := time.NewTicker(time.Duration(globalConfig.JournalSyncInterval) * time.Millisecond)
+	for range ticker.C {
+		d.mutex.Lock()
+		err := d.journal.sync()
+		d.mutex.Unlock()
+		if err != nil {
+			log.Println("journal.sync() :", err)
+		}
+	}
+}
@@ -0,0 +1,61 @@
+package main
+
+import (
+	"bytes"
+	"encoding/binary"
+	"net"
+	"strconv"
+	"strings"
+)
+
+// journalConn sends messages to systemd-journald using its native protocol,
+// one datagram of FIELD=value lines per message
+type journalConn struct {
+	conn net.Conn
+	opts dialOptions
+}
+
+// writeMessage writes m as MESSAGE with PRIORITY, SYSLOG_FACILITY and
+// SYSLOG_IDENTIFIER (SyslogTag, the tag of m or SyslogAppName), the MsgID as
+// CSP_TYPE and every param as CSP_<NAME>, e.g. CSP_DOMAIN and CSP_DIRECTIVE
+func (j *journalConn) writeMessage(p Priority, hostname string, m syslogMessage) error {
+	var b bytes.Buffer
+	journalField(&b, "MESSAGE", m.Msg)
+	journalField(&b, "PRIORITY", strconv.Itoa(int(p&severityMask)))
+	journalField(&b, "SYSLOG_FACILITY", strconv.Itoa(int(p&facilityMask)>>3))
+	identifier := m.Tag
+	if j.opts.tag != "" {
+		identifier = j.opts.tag
+	}
+	if identifier == "" {
+		identifier = j.opts.appName
+	}
+	journalField(&b, "SYSLOG_IDENTIFIER", identifier)
+	if m.MsgID != "" {
+		journalField(&b, "CSP_TYPE", m.MsgID)
+	}
+	for _, param := range m.Params {
+		if param.Value != "" {
+			journalField(&b, "CSP_"+strings.ToUpper(param.Name), param.Value)
+		}
+	}
+	_, err := j.conn.Write(b.Bytes())
+	return err
+}
+
+// journalField appends the field name=value to b. Values with newlines are
+// written as the name, a newline, the little endian 64 bit length and the
+// value.
+func journalField(b *bytes.Buffer, name, value string) {
+	if !strings.Contains(value, "\n") {
+		b.WriteString(name + "=" + value + "\n")
+		return
+	}
+	b.WriteString(name + "\n")
+	binary.Write(b, binary.LittleEndian, uint64(len(value)))
+	b.WriteString(value + "\n")
+}
+
+func (j *journalConn) close() error {
+	return j.conn.Close()
+}
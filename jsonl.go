@@ -0,0 +1,218 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"compress/gzip"
+	"encoding/json"
+	"io"
+	"sync"
+	"time"
+
+	"github.com/klauspost/compress/zstd"
+)
+
+// jsonlRecord is one line in a JSON Lines archive. Reports are normalized so
+// that legacy and Reporting API reports look the same.
+type jsonlRecord struct {
+	Time   time.Time   `json:"time"`
+	Domain string      `json:"domain"`
+	Type   string      `json:"type"`
+	URL    string      `json:"url,omitempty"`
+	Report *report     `json:"csp-report,omitempty"`
+	Body   interface{} `json:"body,omitempty"`
+}
+
+// jsonlStore is a Store that saves reports in compressed JSON Lines files,
+// example.com_YYYY-MM-DD_i.jsonl.gz or .jsonl.zst, with one report per line
+type jsonlStore struct {
+	archiveDir
+	// compress returns a writer compressing to w, and decompress a reader
+	// decompressing r
+	compress   func(w io.Writer) (io.WriteCloser, error)
+	decompress func(r io.Reader) (io.Reader, error)
+	mutex      sync.Mutex // guards pending
+	pending    map[string]*pendingJSONL
+}
+
+// pendingJSONL holds the reports of a domain that are not yet saved to disk
+type pendingJSONL struct {
+	data   bytes.Buffer
+	w      io.WriteCloser
+	fileNr archiveNr
+	lines  []pendingLine
+}
+
+func newJSONLStore(dir, format string) *jsonlStore {
+	s := &jsonlStore{pending: make(map[string]*pendingJSONL)}
+	switch format {
+	case "jsonl.zst":
+		s.archiveDir = archiveDir{dir: dir, ext: ".jsonl.zst"}
+		s.compress = func(w io.Writer) (io.WriteCloser, error) {
+			return zstd.NewWriter(w)
+		}
+		s.decompress = func(r io.Reader) (io.Reader, error) {
+			return zstd.NewReader(r)
+		}
+	default:
+		s.archiveDir = archiveDir{dir: dir, ext: ".jsonl.gz"}
+		s.compress = func(w io.Writer) (io.WriteCloser, error) {
+			return gzip.NewWriter(w), nil
+		}
+		s.decompress = func(r io.Reader) (io.Reader, error) {
+			return gzip.NewReader(r)
+		}
+	}
+	return s
+}
+
+// get returns the pending reports of domain
+func (s *jsonlStore) get(domain string) *pendingJSONL {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	p, ok := s.pending[domain]
+	if !ok {
+		p = new(pendingJSONL)
+		s.pending[domain] = p
+	}
+	return p
+}
+
+// Append writes rec as a new line to the next archive of domain
+func (s *jsonlStore) Append(domain string, rec record) error {
+	if rec.Type == reportTypeTrustedTypes {
+		// Parsed from script-sample, no need to save it twice
+		return nil
+	}
+	line := jsonlRecord{
+		Time:   rec.Time.UTC(),
+		Domain: domain,
+		Type:   rec.Type,
+		URL:    rec.URL,
+		Report: rec.Report,
+		Body:   rec.Body,
+	}
+	b, err := json.Marshal(line)
+	if err != nil {
+		return err
+	}
+
+	p := s.get(domain)
+	if p.w == nil {
+		p.w, err = s.compress(&p.data)
+		if err != nil {
+			return err
+		}
+	}
+	_, err = p.w.Write(append(b, '\n'))
+	if err != nil {
+		return err
+	}
+	p.lines = append(p.lines, pendingLine{raw: b, time: rec.Time})
+	return nil
+}
+
+// Size returns the compressed size of the pending reports of domain
+func (s *jsonlStore) Size(domain string) int64 {
+	return int64(s.get(domain).data.Len())
+}
+
+// Rotate writes all pending reports of domain to a new archive. The reports
+// stay pending if the archive can't be written, and later reports are
+// appended to them as a new gzip member or zstd frame.
+func (s *jsonlStore) Rotate(domain string) error {
+	p := s.get(domain)
+	if p.w != nil {
+		err := p.w.Close()
+		p.w = nil
+		if err != nil {
+			return err
+		}
+	}
+	if p.data.Len() == 0 {
+		return nil
+	}
+	err := s.create(domain, &p.fileNr, p.data.Bytes())
+	if err != nil {
+		return err
+	}
+	p.data.Reset()
+	p.lines = nil
+	return nil
+}
+
+// scanLines decodes every JSON Lines record in the compressed data and calls
+// fn with it. Data may be a stream that is not closed yet.
+func (s *jsonlStore) scanLines(data []byte, fn func(rec record) error) error {
+	r, err := s.decompress(bytes.NewReader(data))
+	if err != nil {
+		return err
+	}
+	scanner := bufio.NewScanner(r)
+	scanner.Buffer(nil, 4*int(globalConfig.MaxCSPReportSize)+1)
+	for scanner.Scan() {
+		line := make([]byte, len(scanner.Bytes()))
+		copy(line, scanner.Bytes())
+		rec, err := parseJSONLLine(line)
+		if err != nil {
+			continue // Skip if errors
+		}
+		err = fn(rec)
+		if err != nil {
+			return err
+		}
+	}
+	err = scanner.Err()
+	if err == io.ErrUnexpectedEOF {
+		// The stream is not closed yet
+		err = nil
+	}
+	return err
+}
+
+// parseJSONLLine decodes one line of a JSON Lines archive
+func parseJSONLLine(line []byte) (record, error) {
+	var l struct {
+		jsonlRecord
+		Body json.RawMessage `json:"body,omitempty"`
+	}
+	err := json.Unmarshal(line, &l)
+	if err != nil {
+		return record{}, err
+	}
+	rec := record{Type: l.Type, URL: l.URL, Raw: line, Report: l.Report, Time: l.Time}
+	if l.Body != nil {
+		rec.Body = l.Body
+	}
+	return rec, nil
+}
+
+// Records calls fn for every report in the archive name
+func (s *jsonlStore) Records(name string, fn func(rec record) error) error {
+	data, _, err := s.read(name)
+	if err != nil {
+		return err
+	}
+	return s.scanLines(data, fn)
+}
+
+// Pending returns a function calling fn for every report in the next
+// archive of domain
+func (s *jsonlStore) Pending(domain string) func(fn func(rec record) error) error {
+	p := s.get(domain)
+	// Lines are only appended, so the copy is not changed by later reports
+	lines := p.lines[:len(p.lines):len(p.lines)]
+	return func(fn func(rec record) error) error {
+		for _, line := range lines {
+			rec, err := parseJSONLLine(line.raw)
+			if err != nil {
+				continue // Skip if errors
+			}
+			err = fn(rec)
+			if err != nil {
+				return err
+			}
+		}
+		return nil
+	}
+}
@@ -0,0 +1,337 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/json"
+	"log"
+	"net/http"
+	"os"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+)
+
+const (
+	// webhookTimeout limits the time spent posting one alert to a webhook
+	webhookTimeout = 10 * time.Second
+	// webhookQueueSize limits the alerts waiting to be posted to webhooks,
+	// alerts that do not fit are dropped
+	webhookQueueSize = 100
+	// maxSeenViolations limits the fingerprints remembered per domain, the
+	// tenth seen the longest ago is forgotten when it is reached
+	maxSeenViolations = 100000
+	// seenViolationMaxAge is how long a fingerprint is remembered after it
+	// was last seen
+	seenViolationMaxAge = 90 * 24 * time.Hour
+)
+
+// seenViolations remembers the fingerprint of every violation a domain has
+// received in the last seenViolationMaxAge, and when it was last seen. The
+// fingerprints are saved one per line in ZipsDir/<domain>.seen as
+// "fingerprint unix-time", encrypted with encryptLine if Encryption is set.
+// New fingerprints are appended, and the file is rewritten with the last
+// seen times when fingerprints are forgotten.
+type seenViolations struct {
+	path string
+	file *os.File
+	seen map[string]time.Time
+}
+
+// openSeenViolations opens the file at path, creating it if needed, and
+// loads the fingerprints in it
+func openSeenViolations(path string) (*seenViolations, error) {
+	f, err := os.OpenFile(path, os.O_RDWR|os.O_CREATE|os.O_APPEND, 0600)
+	if err != nil {
+		return nil, err
+	}
+	s := &seenViolations{path: path, file: f, seen: make(map[string]time.Time)}
+	now := time.Now()
+	end, _, err := readLines(f, maxEncryptedLineSize(128), func(b []byte) {
+		line, err := decryptLine(b)
+		if err != nil {
+			log.Println("seenViolations", path, ":", err)
+			return // Skip if errors
+		}
+		fp, unix, ok := strings.Cut(string(line), " ")
+		t := now
+		if ok {
+			n, err := strconv.ParseInt(unix, 10, 64)
+			if err == nil {
+				t = time.Unix(n, 0)
+			}
+		}
+		s.seen[fp] = t
+	})
+	if err == nil {
+		err = dropTornLine(f, end)
+		if err == errTornLine {
+			log.Println("seenViolations", path, ":", err)
+			err = nil
+		}
+	}
+	if err != nil {
+		f.Close()
+		return nil, err
+	}
+	if len(s.seen) > maxSeenViolations {
+		err = s.forgetOldest(len(s.seen) - maxSeenViolations)
+	}
+	return s, err
+}
+
+// seenLine returns the line saved for fp last seen at t
+func seenLine(fp string, t time.Time) ([]byte, error) {
+	line, err := encryptLine([]byte(fp + " " + strconv.FormatInt(t.Unix(), 10)))
+	if err != nil {
+		return nil, err
+	}
+	return append(line, '\n'), nil
+}
+
+// touch reports whether fp was seen before, and if so remembers that it was
+// last seen at t
+func (s *seenViolations) touch(fp string, t time.Time) bool {
+	if _, ok := s.seen[fp]; !ok {
+		return false
+	}
+	if t.After(s.seen[fp]) {
+		s.seen[fp] = t
+	}
+	return true
+}
+
+// add remembers fp, first seen at t. Once maxSeenViolations are remembered
+// the tenth of the fingerprints seen the longest ago are forgotten.
+func (s *seenViolations) add(fp string, t time.Time) error {
+	if len(s.seen) >= maxSeenViolations {
+		err := s.forgetOldest(maxSeenViolations / 10)
+		if err != nil {
+			return err
+		}
+	}
+	s.seen[fp] = t
+	line, err := seenLine(fp, t)
+	if err != nil {
+		return err
+	}
+	_, err = s.file.Write(line)
+	return err
+}
+
+// forgetOldest forgets the n fingerprints seen the longest ago and rewrites
+// the file
+func (s *seenViolations) forgetOldest(n int) error {
+	fps := make([]string, 0, len(s.seen))
+	for fp := range s.seen {
+		fps = append(fps, fp)
+	}
+	sort.Slice(fps, func(i, j int) bool { return s.seen[fps[i]].Before(s.seen[fps[j]]) })
+	if n > len(fps) {
+		n = len(fps)
+	}
+	for _, fp := range fps[:n] {
+		delete(s.seen, fp)
+	}
+	log.Println("seenViolations :", s.path, "holds", maxSeenViolations, "fingerprints, forgot the", n, "seen the longest ago")
+	return s.compact()
+}
+
+// prune forgets the fingerprints not seen in seenViolationMaxAge and
+// rewrites the file to save when the rest were last seen
+func (s *seenViolations) prune(now time.Time) error {
+	for fp, t := range s.seen {
+		if now.Sub(t) > seenViolationMaxAge {
+			delete(s.seen, fp)
+		}
+	}
+	return s.compact()
+}
+
+// compact replaces the file with one line per remembered fingerprint
+func (s *seenViolations) compact() error {
+	tmp := s.path + ".tmp"
+	f, err := os.OpenFile(tmp, os.O_WRONLY|os.O_CREATE|os.O_TRUNC, 0600)
+	if err != nil {
+		return err
+	}
+	w := bufio.NewWriter(f)
+	for fp, t := range s.seen {
+		line, err := seenLine(fp, t)
+		if err == nil {
+			_, err = w.Write(line)
+		}
+		if err != nil {
+			f.Close()
+			os.Remove(tmp)
+			return err
+		}
+	}
+	err = w.Flush()
+	if err == nil {
+		err = f.Sync()
+	}
+	f.Close()
+	if err == nil {
+		err = os.Rename(tmp, s.path)
+	}
+	if err != nil {
+		os.Remove(tmp)
+		return err
+	}
+
+	// Appends go to the new file
+	f, err = os.OpenFile(s.path, os.O_WRONLY|os.O_APPEND, 0600)
+	if err != nil {
+		return err
+	}
+	s.file.Close()
+	s.file = f
+	return nil
+}
+
+// newViolation is sent to syslog and NewViolationWebhook the first time a
+// violation is seen
+type newViolation struct {
+	Domain        string    `json:"domain"`
+	Fingerprint   string    `json:"fingerprint"`
+	DocumentPath  string    `json:"document-path"`
+	Directive     string    `json:"directive"`
+	BlockedOrigin string    `json:"blocked-origin"`
+	SourceFile    string    `json:"source-file"`
+	FirstSeen     time.Time `json:"first-seen"`
+	Report        *report   `json:"csp-report"`
+}
+
+// checkNewViolation alerts if the CSP violation in rec was never seen by d
+// before. While d.alerts is out of alerts the violation is not remembered,
+// so that it alerts when it is seen again once alerts are allowed. Line
+// numbers are ignored so that a new deploy of the same script does not alert
+// again.
+// It must be called with d.mutex held.
+func (d *domain) checkNewViolation(rec record) {
+	k := newViolationKey(rec.Report)
+	k.LineNumber = 0
+	fp := k.fingerprint()
+	if d.seen.touch(fp, rec.Time) || !d.alerts.allow(rec.Time) {
+		return
+	}
+	err := d.seen.add(fp, rec.Time)
+	if err != nil {
+		log.Println("seenViolations.add() :", err)
+	}
+
+	body, err := json.Marshal(newViolation{
+		Domain:        d.name,
+		Fingerprint:   fp,
+		DocumentPath:  k.DocumentPath,
+		Directive:     k.Directive,
+		BlockedOrigin: k.BlockedOrigin,
+		SourceFile:    k.SourceFile,
+		FirstSeen:     rec.Time.UTC(),
+		Report:        rec.Report,
+	})
+	if err != nil {
+		log.Println("json.Marshal() :", err)
+		return
+	}
+	if !globalConfig.Silent {
+		log.Println("New CSP violation from Domain", d.name, ":", string(body))
+	}
+	if globalConfig.Syslog != "" {
+		d.queueSyslog(syslogMessage{
+			Tag:      d.name,
+			Domain:   d.name,
+			Severity: globalSyslogAlertSeverity,
+			MsgID:    "new-violation",
+			Params: []syslogParam{
+				{"domain", d.name},
+				{"fingerprint", fp},
+				{"directive", k.Directive},
+				{"blocked", k.BlockedOrigin},
+				{"document", k.DocumentPath},
+			},
+			Msg: "New CSP violation from Domain " + d.name + " : " + string(body),
+		})
+	}
+	if globalConfig.NewViolationWebhook != "" {
+		queueWebhook(globalConfig.NewViolationWebhook, body)
+	}
+}
+
+// alertLimiter is a token bucket limiting the alerts of a domain to
+// MaxAlertsPerHour, allowing bursts of as many
+type alertLimiter struct {
+	tokens float64
+	last   time.Time
+	// suppressed counts the alerts that were not sent
+	suppressed int64
+}
+
+// allow takes a token at now and reports whether an alert may be sent
+func (l *alertLimiter) allow(now time.Time) bool {
+	max := float64(globalConfig.MaxAlertsPerHour)
+	if l.last.IsZero() {
+		l.tokens = max
+	} else if now.After(l.last) {
+		l.tokens += now.Sub(l.last).Hours() * max
+		if l.tokens > max {
+			l.tokens = max
+		}
+	}
+	if now.After(l.last) {
+		l.last = now
+	}
+	if l.tokens < 1 {
+		l.suppressed++
+		return false
+	}
+	l.tokens--
+	return true
+}
+
+// webhookPost is an alert waiting to be posted to a webhook
+type webhookPost struct {
+	url  string
+	body []byte
+}
+
+// globalWebhooks queues the alerts posted by sendWebhooks
+var globalWebhooks = make(chan webhookPost, webhookQueueSize)
+
+// queueWebhook queues body to be posted as JSON to url, or drops it if
+// webhookQueueSize alerts are already waiting
+func queueWebhook(url string, body []byte) {
+	globalWebhookWait.Add(1)
+	select {
+	case globalWebhooks <- webhookPost{url: url, body: body}:
+	default:
+		globalWebhookWait.Done()
+		log.Println("queueWebhook() : queue full, dropped alert to", url)
+	}
+}
+
+// sendWebhooks posts the queued alerts one at a time.
+// Note that sendWebhooks will not return so call it in a new gorutine.
+func sendWebhooks() {
+	for p := range globalWebhooks {
+		postWebhook(p.url, p.body)
+	}
+}
+
+// postWebhook posts body as JSON to url and marks it done in
+// globalWebhookWait
+func postWebhook(url string, body []byte) {
+	defer globalWebhookWait.Done()
+	client := http.Client{Timeout: webhookTimeout}
+	resp, err := client.Post(url, "application/json", bytes.NewReader(body))
+	if err != nil {
+		log.Println("postWebhook() :", err)
+		return
+	}
+	resp.Body.Close()
+	if resp.StatusCode >= 300 {
+		log.Println("postWebhook() :", url, "returned", resp.Status)
+	}
+}
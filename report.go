@@ -1,18 +1,60 @@
 package main
 
 import (
+	"bytes"
 	"encoding/json"
+	"errors"
 	"fmt"
 	"io/ioutil"
 	"log"
+	"mime"
 	"net/http"
 	"net/url"
 	"path/filepath"
+	"strings"
 	"time"
 )
 
-type cspReport struct {
-	R report `json:"csp-report"`
+// Report types, named as in the type field of Reporting API reports
+const (
+	reportTypeCSP               = "csp-violation"
+	reportTypeCOEP              = "coep"
+	reportTypeCOOP              = "coop"
+	reportTypePermissionsPolicy = "permissions-policy-violation"
+	reportTypeDeprecation       = "deprecation"
+	reportTypeIntervention      = "intervention"
+	reportTypeCrash             = "crash"
+	reportTypeNEL               = "network-error"
+	reportTypeExpectCT          = "expect-ct"
+	reportTypeHPKP              = "hpkp"
+	reportTypeExpectStaple      = "expect-staple"
+
+	// reportTypeTrustedTypes is not sent by browsers, it names the zip file
+	// with the parsed samples of Trusted Types violations
+	reportTypeTrustedTypes = "trusted-types"
+)
+
+// reportTypeLabels holds the names used for each report type in syslog
+var reportTypeLabels = map[string]string{
+	reportTypeCSP:               "CSP",
+	reportTypeCOEP:              "COEP",
+	reportTypeCOOP:              "COOP",
+	reportTypePermissionsPolicy: "Permissions-Policy",
+	reportTypeDeprecation:       "Deprecation",
+	reportTypeIntervention:      "Intervention",
+	reportTypeCrash:             "Crash",
+	reportTypeNEL:               "NEL",
+	reportTypeExpectCT:          "Expect-CT",
+	reportTypeHPKP:              "HPKP",
+	reportTypeExpectStaple:      "Expect-Staple",
+}
+
+// legacyReport is the envelope used by browsers sending reports to a
+// report-uri
+type legacyReport struct {
+	CSP          *report             `json:"csp-report"`
+	ExpectCT     *expectCTReport     `json:"expect-ct-report"`
+	ExpectStaple *expectStapleReport `json:"expect-staple-report"`
 }
 
 type report struct {
@@ -28,57 +70,579 @@ type report struct {
 	Disposition        string `json:"disposition"`
 	StatusCode         int    `json:"status-code"`
 	ColumnNumber       int    `json:"column-number"`
+
+	// Sink and payload of a Trusted Types violation, parsed from ScriptSample
+	// by parseTrustedTypesSample
+	TrustedTypesSink    string `json:"trusted-types-sink,omitempty"`
+	TrustedTypesPayload string `json:"trusted-types-payload,omitempty"`
 }
 
-func reportSrv(w http.ResponseWriter, req *http.Request) {
-	req.Body = http.MaxBytesReader(w, req.Body, globalConfig.MaxCSPReportSize)
-	body, err := ioutil.ReadAll(req.Body)
+// parseTrustedTypesSample splits the sample of a require-trusted-types-for
+// violation, e.g. "Element innerHTML|<img src=x>", into sink and payload
+func (r *report) parseTrustedTypesSample() {
+	// Only trust the sink and payload parsed here, not ones sent by clients
+	r.TrustedTypesSink, r.TrustedTypesPayload = "", ""
+	if r.EffectiveDirective != "require-trusted-types-for" {
+		return
+	}
+	sink, payload, found := strings.Cut(r.ScriptSample, "|")
+	if !found {
+		return
+	}
+	r.TrustedTypesSink = sink
+	r.TrustedTypesPayload = payload
+}
+
+// trustedTypesViolation is saved in the zip for every Trusted Types violation
+type trustedTypesViolation struct {
+	Sink         string `json:"sink"`
+	Payload      string `json:"payload"`
+	DocumentURI  string `json:"document-uri"`
+	SourceFile   string `json:"source-file"`
+	LineNumber   int    `json:"line-number"`
+	ColumnNumber int    `json:"column-number"`
+	Disposition  string `json:"disposition"`
+}
+
+type coepReport struct {
+	Type        string `json:"type"`
+	BlockedURL  string `json:"blockedURL"`
+	Destination string `json:"destination"`
+	Disposition string `json:"disposition"`
+}
+
+type coopReport struct {
+	Type                string `json:"type"`
+	Disposition         string `json:"disposition"`
+	EffectivePolicy     string `json:"effectivePolicy"`
+	PreviousResponseURL string `json:"previousResponseURL"`
+	NextResponseURL     string `json:"nextResponseURL"`
+	Referrer            string `json:"referrer"`
+	Property            string `json:"property"`
+	SourceFile          string `json:"sourceFile"`
+	LineNumber          int    `json:"lineNumber"`
+	ColumnNumber        int    `json:"columnNumber"`
+}
+
+type permissionsPolicyReport struct {
+	FeatureID    string `json:"featureId"`
+	Disposition  string `json:"disposition"`
+	Message      string `json:"message"`
+	SourceFile   string `json:"sourceFile"`
+	LineNumber   int    `json:"lineNumber"`
+	ColumnNumber int    `json:"columnNumber"`
+}
+
+type deprecationReport struct {
+	ID                 string `json:"id"`
+	AnticipatedRemoval string `json:"anticipatedRemoval"`
+	Message            string `json:"message"`
+	SourceFile         string `json:"sourceFile"`
+	LineNumber         int    `json:"lineNumber"`
+	ColumnNumber       int    `json:"columnNumber"`
+}
+
+type interventionReport struct {
+	ID           string `json:"id"`
+	Message      string `json:"message"`
+	SourceFile   string `json:"sourceFile"`
+	LineNumber   int    `json:"lineNumber"`
+	ColumnNumber int    `json:"columnNumber"`
+}
+
+type crashReport struct {
+	Reason          string `json:"reason"`
+	Stack           string `json:"stack"`
+	IsTopLevel      bool   `json:"is_top_level"`
+	VisibilityState string `json:"visibility_state"`
+}
+
+type expectCTReport struct {
+	DateTime                  string   `json:"date-time"`
+	Hostname                  string   `json:"hostname"`
+	Port                      int      `json:"port"`
+	EffectiveExpirationDate   string   `json:"effective-expiration-date"`
+	ServedCertificateChain    []string `json:"served-certificate-chain"`
+	ValidatedCertificateChain []string `json:"validated-certificate-chain"`
+	SCTs                      []struct {
+		Version       int    `json:"version"`
+		Status        string `json:"status"`
+		Source        string `json:"source"`
+		SerializedSCT string `json:"serialized_sct"`
+	} `json:"scts"`
+}
+
+// hpkpReport is sent without an envelope, to tell it apart from other
+// reports it must have both hostname and known-pins
+type hpkpReport struct {
+	DateTime                  string   `json:"date-time"`
+	Hostname                  string   `json:"hostname"`
+	Port                      int      `json:"port"`
+	EffectiveExpirationDate   string   `json:"effective-expiration-date"`
+	IncludeSubdomains         bool     `json:"include-subdomains"`
+	NotedHostname             string   `json:"noted-hostname"`
+	ServedCertificateChain    []string `json:"served-certificate-chain"`
+	ValidatedCertificateChain []string `json:"validated-certificate-chain"`
+	KnownPins                 []string `json:"known-pins"`
+}
+
+type expectStapleReport struct {
+	DateTime                  string   `json:"date-time"`
+	Hostname                  string   `json:"hostname"`
+	Port                      int      `json:"port"`
+	ResponseStatus            string   `json:"response-status"`
+	OCSPResponse              string   `json:"ocsp-response"`
+	CertStatus                string   `json:"cert-status"`
+	ServedCertificateChain    []string `json:"served-certificate-chain"`
+	ValidatedCertificateChain []string `json:"validated-certificate-chain"`
+}
+
+// nelReport is the body of a Network Error Logging report
+type nelReport struct {
+	Phase            string  `json:"phase"`
+	Type             string  `json:"type"`
+	ElapsedTime      int64   `json:"elapsed_time"`
+	SamplingFraction float64 `json:"sampling_fraction"`
+	ServerIP         string  `json:"server_ip"`
+	StatusCode       int     `json:"status_code"`
+	Protocol         string  `json:"protocol"`
+	Method           string  `json:"method"`
+	Referrer         string  `json:"referrer"`
+}
+
+// reportBodies returns a new typed body for each non CSP report type
+var reportBodies = map[string]func() interface{}{
+	reportTypeCOEP:              func() interface{} { return new(coepReport) },
+	reportTypeCOOP:              func() interface{} { return new(coopReport) },
+	reportTypePermissionsPolicy: func() interface{} { return new(permissionsPolicyReport) },
+	reportTypeDeprecation:       func() interface{} { return new(deprecationReport) },
+	reportTypeIntervention:      func() interface{} { return new(interventionReport) },
+	reportTypeCrash:             func() interface{} { return new(crashReport) },
+	reportTypeNEL:               func() interface{} { return new(nelReport) },
+}
+
+// record is one report found in a request body
+type record struct {
+	Type string
+	// URL is the document the report is about and decides which domain the
+	// report belongs to, unless Hostname is set
+	URL      string
+	Hostname string
+	// Raw is the JSON saved in the zip and sent to syslog
+	Raw []byte
+	// Report is set for CSP violations and Body for all other report types
+	Report *report
+	Body   interface{}
+	// Time is when the report was generated
+	Time time.Time
+	// Replayed is set for reports replayed from the journal, stores that save
+	// reports as they arrive already have them
+	Replayed bool
+	// Member is the file in the zip a stored report was read from
+	Member string
+}
+
+// reportingAPIReport is one entry of a W3C Reporting API batch, delivered
+// with Content-Type application/reports+json via report-to or
+// Reporting-Endpoints.
+type reportingAPIReport struct {
+	Type      string          `json:"type"`
+	Age       int64           `json:"age"`
+	URL       string          `json:"url"`
+	UserAgent string          `json:"user_agent"`
+	Body      json.RawMessage `json:"body"`
+}
+
+// cspViolationBody is the body of a Reporting API report of type
+// csp-violation
+type cspViolationBody struct {
+	DocumentURL        string `json:"documentURL"`
+	Referrer           string `json:"referrer"`
+	BlockedURL         string `json:"blockedURL"`
+	EffectiveDirective string `json:"effectiveDirective"`
+	OriginalPolicy     string `json:"originalPolicy"`
+	SourceFile         string `json:"sourceFile"`
+	Sample             string `json:"sample"`
+	Disposition        string `json:"disposition"`
+	StatusCode         int    `json:"statusCode"`
+	LineNumber         int    `json:"lineNumber"`
+	ColumnNumber       int    `json:"columnNumber"`
+}
+
+// toReport maps b onto the legacy report struct so that both report formats
+// are handled the same way
+func (b cspViolationBody) toReport() report {
+	return report{
+		BlockedURI:         b.BlockedURL,
+		DocumentURI:        b.DocumentURL,
+		LineNumber:         b.LineNumber,
+		OriginalPolicy:     b.OriginalPolicy,
+		Referrer:           b.Referrer,
+		ScriptSample:       b.Sample,
+		SourceFile:         b.SourceFile,
+		ViolatedDirective:  b.EffectiveDirective,
+		EffectiveDirective: b.EffectiveDirective,
+		Disposition:        b.Disposition,
+		StatusCode:         b.StatusCode,
+		ColumnNumber:       b.ColumnNumber,
+	}
+}
+
+// parseReports decodes body as a legacy report, a single Reporting API report
+// or a Reporting API batch and returns every report found
+func parseReports(contentType string, body []byte) (records []record, err error) {
+	if contentType == "application/reports+json" || bytes.HasPrefix(bytes.TrimSpace(body), []byte("[")) {
+		var batch []json.RawMessage
+		err = json.Unmarshal(body, &batch)
+		if err != nil {
+			return nil, err
+		}
+		for _, raw := range batch {
+			rec, err := parseReportingAPIReport(raw)
+			if err != nil {
+				continue // Skip reports we can't handle
+			}
+			records = append(records, rec)
+		}
+		return records, nil
+	}
+
+	var legacy legacyReport
+	err = json.Unmarshal(body, &legacy)
 	if err != nil {
-		return // Skip if errors
+		return nil, err
+	}
+	now := time.Now()
+	switch {
+	case legacy.CSP != nil:
+		legacy.CSP.parseTrustedTypesSample()
+		return []record{{Type: reportTypeCSP, URL: legacy.CSP.DocumentURI, Raw: body, Report: legacy.CSP, Time: now}}, nil
+	case legacy.ExpectCT != nil:
+		return []record{{Type: reportTypeExpectCT, Hostname: legacy.ExpectCT.Hostname, Raw: body, Body: legacy.ExpectCT, Time: now}}, nil
+	case legacy.ExpectStaple != nil:
+		return []record{{Type: reportTypeExpectStaple, Hostname: legacy.ExpectStaple.Hostname, Raw: body, Body: legacy.ExpectStaple, Time: now}}, nil
+	}
+
+	var hpkp hpkpReport
+	if json.Unmarshal(body, &hpkp) == nil && hpkp.Hostname != "" && hpkp.KnownPins != nil {
+		return []record{{Type: reportTypeHPKP, Hostname: hpkp.Hostname, Raw: body, Body: &hpkp, Time: now}}, nil
 	}
-	var report cspReport
-	err = json.Unmarshal(body, &report)
+
+	rec, err := parseReportingAPIReport(body)
 	if err != nil {
-		return // Skip if errors
+		return nil, err
 	}
-	u, err := url.Parse(report.R.DocumentURI)
+	return []record{rec}, nil
+}
+
+// parseReportingAPIReport decodes one Reporting API report and its typed body
+func parseReportingAPIReport(raw []byte) (rec record, err error) {
+	var r reportingAPIReport
+	err = json.Unmarshal(raw, &r)
 	if err != nil {
-		return // Skip if errors
+		return rec, err
 	}
+	// Age is the number of milliseconds between generating and sending the report
+	rec = record{Type: r.Type, URL: r.URL, Raw: raw, Time: time.Now().Add(-time.Duration(r.Age) * time.Millisecond)}
 
-	d, ok := globalDomainMap[filepath.Base(u.Hostname())]
-	if ok {
-		if !globalConfig.Silent {
-			fmt.Println(string(body), "\n", filepath.Base(u.Hostname()), "\n\n")
+	if r.Type == reportTypeCSP {
+		var b cspViolationBody
+		err = json.Unmarshal(r.Body, &b)
+		if err != nil {
+			return rec, err
 		}
-		d.mutex.Lock()
-		if globalConfig.Syslog != "" {
-			go sendSyslogMessage(d.name, string(body))
+		if b.DocumentURL == "" {
+			b.DocumentURL = r.URL
 		}
-		d.textInZip.Write(body)
-		d.textInZip.Write([]byte("\n"))
-		d.nr++
-		if d.nr > globalConfig.MaxReportsPerZip {
-			d.mutex.Unlock()
-			d.flush()
+		report := b.toReport()
+		report.parseTrustedTypesSample()
+		rec.URL = report.DocumentURI
+		rec.Report = &report
+		return rec, nil
+	}
+
+	newBody, ok := reportBodies[r.Type]
+	if !ok {
+		return rec, fmt.Errorf("unknown report type %q", r.Type)
+	}
+	rec.Body = newBody()
+	err = json.Unmarshal(r.Body, rec.Body)
+	return rec, err
+}
+
+// allowedContentTypes lists the media types browsers use when sending
+// reports to ReportURI
+var allowedContentTypes = map[string]bool{
+	"application/csp-report":   true,
+	"application/json":         true,
+	"application/reports+json": true,
+	// Expect-CT reports, HPKP and Expect-Staple reports use application/json
+	"application/expect-ct-report+json": true,
+}
+
+// setCORSHeaders allows browsers to deliver reports to ReportURI from any
+// origin
+func setCORSHeaders(w http.ResponseWriter, req *http.Request) {
+	origin := req.Header.Get("Origin")
+	if origin == "" {
+		origin = "*"
+	}
+	w.Header().Set("Access-Control-Allow-Origin", origin)
+	w.Header().Add("Vary", "Origin")
+}
+
+func reportSrv(w http.ResponseWriter, req *http.Request) {
+	switch req.Method {
+	case http.MethodOptions:
+		// CORS preflight sent before cross-origin Reporting API batches
+		setCORSHeaders(w, req)
+		w.Header().Set("Access-Control-Allow-Methods", "POST, OPTIONS")
+		w.Header().Set("Access-Control-Allow-Headers", "Content-Type")
+		w.Header().Set("Access-Control-Max-Age", "86400")
+		w.WriteHeader(http.StatusNoContent)
+		return
+	case http.MethodPost:
+		setCORSHeaders(w, req)
+	default:
+		w.Header().Set("Allow", "POST, OPTIONS")
+		http.Error(w, "", http.StatusMethodNotAllowed)
+		return
+	}
+
+	contentType, _, err := mime.ParseMediaType(req.Header.Get("Content-Type"))
+	if err != nil || !allowedContentTypes[contentType] {
+		http.Error(w, "", http.StatusUnsupportedMediaType)
+		return
+	}
+
+	req.Body = http.MaxBytesReader(w, req.Body, globalConfig.MaxCSPReportSize)
+	body, err := ioutil.ReadAll(req.Body)
+	if err != nil {
+		var maxBytesErr *http.MaxBytesError
+		if errors.As(err, &maxBytesErr) {
+			http.Error(w, "", http.StatusRequestEntityTooLarge)
 		} else {
+			http.Error(w, "", http.StatusBadRequest)
+		}
+		return
+	}
+	records, err := parseReports(contentType, body)
+	if err != nil {
+		http.Error(w, "", http.StatusBadRequest)
+		return
+	}
+	for _, rec := range records {
+		hostname := rec.Hostname
+		if hostname == "" {
+			u, err := url.Parse(rec.URL)
+			if err != nil {
+				continue // Skip if errors
+			}
+			hostname = u.Hostname()
+		}
+		d, ok := globalDomainMap[filepath.Base(hostname)]
+		if ok {
+			err = d.addReport(rec)
+			if err != nil {
+				log.Println("addReport() :", err)
+				http.Error(w, "", http.StatusInternalServerError)
+				return
+			}
+		}
+	}
+	w.WriteHeader(http.StatusNoContent)
+}
+
+// addReport writes the raw JSON of rec to d's journal, zip and syslog, and
+// flushes d if the zip is full. In dedup mode CSP violations are held back
+// and counted until the end of the DedupWindow.
+func (d *domain) addReport(rec record) error {
+	if !globalConfig.Silent {
+		fmt.Print(string(rec.Raw), "\n ", d.name, "\n\n\n")
+	}
+	defer d.sendQueuedSyslog()
+	d.mutex.Lock()
+	if d.rates != nil {
+		d.rates.add(rec.directive())
+	}
+	if rec.Report != nil {
+		d.stats.add(rec.Report, time.Now())
+		if d.seen != nil {
+			d.checkNewViolation(rec)
+		}
+		fp := d.fingerprints.seen(newViolationKey(rec.Report), rec.Time)
+		if globalConfig.Dedup {
+			// Journal the violation so that it is held again after a crash
+			if d.journal != nil {
+				err := d.journal.append(rec.Raw)
+				if err != nil {
+					d.mutex.Unlock()
+					return err
+				}
+			}
+			d.hold(rec, fp)
+			full := d.full()
 			d.mutex.Unlock()
+			if full {
+				d.flush()
+			}
+			return nil
 		}
 	}
+	err := d.commit(rec)
+	full := d.full()
+	d.mutex.Unlock()
+	if full {
+		d.flush()
+	}
+	return err
 }
 
-func sendSyslogMessage(name, body string) {
-	sysLog, err := Dial(globalConfig.Transport, globalConfig.Syslog, LOG_WARNING|LOG_DAEMON, name)
+// commit writes the raw JSON of rec to d's journal and zip, and queues it for
+// syslog.
+// It must be called with d.mutex held.
+func (d *domain) commit(rec record) error {
+	if d.journal != nil {
+		err := d.journal.append(rec.Raw)
+		if err != nil {
+			return err
+		}
+	}
+	if globalConfig.Syslog != "" {
+		d.queueSyslog(syslogMessageFor(d.name, rec))
+	}
+	d.store(rec)
+	return nil
+}
+
+// full reports whether the pending reports of d should be flushed. In dedup
+// mode the held violations count as reports, and the journal holding them
+// counts toward MaxBytes.
+// It must be called with d.mutex held.
+func (d *domain) full() bool {
+	if d.nr+d.held > globalConfig.MaxReportsPerZip {
+		return true
+	}
+	if d.rotation.MaxBytes <= 0 {
+		return false
+	}
+	if globalConfig.Dedup && d.journal != nil && d.journal.size > d.rotation.MaxBytes {
+		return true
+	}
+	return globalStore.Size(d.name) > d.rotation.MaxBytes
+}
+
+// store appends rec to d in globalStore and updates the counters shown on the
+// domain page.
+// It must be called with d.mutex held.
+func (d *domain) store(rec record) {
+	if d.nr == 0 {
+		d.oldest = time.Now()
+	}
+	err := globalStore.Append(d.name, rec)
 	if err != nil {
-		if !globalConfig.Silent {
-			log.Println(err)
+		log.Println("Store.Append() :", err)
+	}
+	if rec.Report != nil && rec.Report.TrustedTypesSink != "" {
+		addLimited(d.trustedTypesSinks, rec.Report.TrustedTypesSink)
+		tt := &trustedTypesViolation{
+			Sink:         rec.Report.TrustedTypesSink,
+			Payload:      rec.Report.TrustedTypesPayload,
+			DocumentURI:  rec.Report.DocumentURI,
+			SourceFile:   rec.Report.SourceFile,
+			LineNumber:   rec.Report.LineNumber,
+			ColumnNumber: rec.Report.ColumnNumber,
+			Disposition:  rec.Report.Disposition,
+		}
+		raw, err := json.Marshal(tt)
+		if err == nil {
+			// Without Report the record is saved by type, not with the
+			// require-trusted-types-for violations
+			err = globalStore.Append(d.name, record{Type: reportTypeTrustedTypes, Raw: raw, Body: tt, URL: rec.URL, Time: rec.Time})
+			if err != nil {
+				log.Println("Store.Append() :", err)
+			}
 		}
-	} else {
-		fmt.Fprintf(sysLog, "CSP report from Domain "+name+" : "+body)
 	}
+	if nel, ok := rec.Body.(*nelReport); ok {
+		addLimited(d.nelByType, nel.Type)
+		addLimited(d.nelByServerIP, nel.ServerIP)
+	}
+	d.nr++
+}
+
+// syslogMessageFor returns rec rendered with SyslogTemplate, tagged by
+// syslogTag and with the severity of the first matching SyslogSeverity rule
+func syslogMessageFor(name string, rec record) syslogMessage {
+	text, err := syslogText(name, rec)
+	if err != nil {
+		log.Println("SyslogTemplate.Execute() :", err)
+		text = string(rec.Raw)
+	}
+	return syslogMessage{
+		Tag:      syslogTag(name, rec),
+		Domain:   name,
+		Severity: syslogSeverity(rec),
+		MsgID:    rec.Type,
+		Params:   syslogParams(name, rec),
+		Msg:      text,
+	}
+}
+
+// syslogTag returns the tag of rec received by domain name: the domain name,
+// or e.g. example.com-expect-ct for Expect-CT, HPKP and Expect-Staple reports
+// so they can be told apart from CSP violations by the tag alone
+func syslogTag(name string, rec record) string {
+	switch rec.Type {
+	case reportTypeExpectCT, reportTypeHPKP, reportTypeExpectStaple:
+		return name + "-" + rec.Type
+	}
+	return name
 }
 
-func cspReportListener() {
+// syslogParams returns the fields of rec sent as structured data in RFC 5424
+// messages
+func syslogParams(name string, rec record) []syslogParam {
+	params := []syslogParam{{"domain", name}}
+	if rec.Report == nil {
+		return append(params, syslogParam{"document", rec.URL})
+	}
+	return append(params,
+		syslogParam{"directive", rec.directive()},
+		syslogParam{"blocked", rec.Report.BlockedURI},
+		syslogParam{"document", rec.Report.DocumentURI},
+		syslogParam{"disposition", rec.Report.Disposition},
+	)
+}
+
+// sendSyslog queues m to syslog
+func sendSyslog(m syslogMessage) {
+	globalSyslog.send(m)
+}
+
+// queueSyslog queues m to be sent to syslog by d.sendQueuedSyslog.
+// It must be called with d.mutex held.
+func (d *domain) queueSyslog(m syslogMessage) {
+	d.syslogOut = append(d.syslogOut, m)
+}
+
+// sendQueuedSyslog sends the messages queued by d.queueSyslog in order.
+// Sending can block, so it must be called without d.mutex held.
+func (d *domain) sendQueuedSyslog() {
+	d.syslogMutex.Lock()
+	defer d.syslogMutex.Unlock()
+	d.mutex.Lock()
+	out := d.syslogOut
+	d.syslogOut = nil
+	d.mutex.Unlock()
+	for _, m := range out {
+		sendSyslog(m)
+	}
+}
+
+// cspReportListener starts the server receiving reports on ReportURI and
+// returns it
+func cspReportListener() *http.Server {
 	s := &http.Server{
 		Addr:           globalConfig.ReportURI,
 		Handler:        http.HandlerFunc(reportSrv),
@@ -86,7 +650,13 @@ func cspReportListener() {
 		WriteTimeout:   5 * time.Second,
 		MaxHeaderBytes: int(globalConfig.MaxCSPReportSize),
 	}
-	log.Fatalln(s.ListenAndServe())
+	go func() {
+		err := s.ListenAndServe()
+		if err != http.ErrServerClosed {
+			log.Fatalln(err)
+		}
+	}()
+	return s
 }
 
 ///////////////////////////////////////////////////////////////////////////////
@@ -1,12 +1,12 @@
 package main
 
 import (
+	"bytes"
 	"html/template"
 	"log"
 	"net/http"
 	"net/url"
-	"os"
-	"path/filepath"
+	"time"
 )
 
 // mainpageServer serves all requests to /
@@ -46,14 +46,44 @@ func newDomainPageServer(name string) (srv *domainPageServer, err error) {
 }
 
 type domainPage struct {
-	Name    string
-	Nr      int64
-	ZipList []zipInfo
-	Nonce   string
+	Name          string
+	Nr            int64
+	ZipList       []zipInfo
+	Nonce         string
+	NELByType     []keyCount
+	NELByServerIP []keyCount
+
+	TrustedTypesSinks []keyCount
+
+	// CSP violations in the last 24 hours
+	Stats          violationStats
+	StatsSparkline string
+
+	// Most common violations by fingerprint
+	TopViolations []fingerprintEntry
+
+	// Most recent report spikes, newest first
+	SpikeAlerts []spikeAlert
+
+	// Syslog messages dropped because the syslog queue was full
+	SyslogDropped int64
+
+	// Alerts not sent because of MaxAlertsPerHour
+	AlertsSuppressed int64
 }
 
+// Size of the sparkline on the domain page
+const (
+	sparklineWidth  = 300
+	sparklineHeight = 40
+)
+
+// maxAggregateRows is the maximum number of rows shown in each table on the
+// domain page
+const maxAggregateRows = 25
+
 func (srv *domainPageServer) ServeHTTP(w http.ResponseWriter, req *http.Request) {
-	zipList, err := getZipList(srv.Name)
+	zipList, err := globalStore.List(srv.Name)
 	if err != nil {
 		http.Error(w, "", http.StatusInternalServerError)
 		return
@@ -67,9 +97,29 @@ func (srv *domainPageServer) ServeHTTP(w http.ResponseWriter, req *http.Request)
 	domain, ok := globalDomainMap[srv.Name]
 	if ok {
 		domain.mutex.Lock()
-		nr := domain.nr
+		dp = domainPage{
+			Name:          srv.Name,
+			Nr:            domain.nr,
+			ZipList:       zipList,
+			Nonce:         nonce,
+			NELByType:     domain.nelByType.top(maxAggregateRows),
+			NELByServerIP: domain.nelByServerIP.top(maxAggregateRows),
+
+			TrustedTypesSinks: domain.trustedTypesSinks.top(maxAggregateRows),
+
+			Stats: domain.stats.summary("24h", time.Now()),
+
+			TopViolations: domain.fingerprints.top(maxAggregateRows),
+		}
+		dp.StatsSparkline = sparkline(dp.Stats.Series, sparklineWidth, sparklineHeight)
+		if domain.rates != nil {
+			dp.SpikeAlerts = append(dp.SpikeAlerts, domain.rates.alerts...)
+		}
+		if globalSyslog != nil {
+			dp.SyslogDropped = globalSyslog.droppedFor(srv.Name)
+		}
+		dp.AlertsSuppressed = domain.alerts.suppressed
 		domain.mutex.Unlock()
-		dp = domainPage{Name: srv.Name, Nr: nr, ZipList: zipList, Nonce: nonce}
 	} else {
 		dp = domainPage{Name: srv.Name, ZipList: zipList, Nonce: nonce}
 	}
@@ -79,8 +129,10 @@ func (srv *domainPageServer) ServeHTTP(w http.ResponseWriter, req *http.Request)
 	srv.Page.Execute(w, dp)
 }
 
-// getZipServer handles requests to /get/ and serves .zip files from the
-// globalConfig.ZipPageURI directory
+// getZipServer handles requests to /get/ and serves archives from
+// globalStore. Encrypted archives are served as they are, or decrypted if
+// the query has decrypt=1 and the request is authenticated as one of
+// DecryptUsers.
 func getZipServer(w http.ResponseWriter, req *http.Request) {
 
 	file := fileNameFromURL(req.URL.Path)
@@ -91,15 +143,37 @@ func getZipServer(w http.ResponseWriter, req *http.Request) {
 		return
 	}
 
-	if filepath.Ext(file) == ".zip" && ref.Host == globalConfig.ZipPageURI {
-		http.ServeFile(w, req, globalConfig.ZipsDir+file)
-	} else {
+	if ref.Host != globalConfig.ZipPageURI {
+		http.Error(w, "", http.StatusInternalServerError)
+		return
+	}
+	archive, modTime, err := globalStore.Open(file)
+	if err != nil {
 		http.Error(w, "", http.StatusInternalServerError)
+		return
+	}
+	defer archive.Close()
+
+	if req.URL.Query().Get("decrypt") == "1" && isEncrypted(file) {
+		if !decryptAllowed(req) {
+			w.Header().Set("WWW-Authenticate", `Basic realm="cspreporter"`)
+			http.Error(w, "", http.StatusUnauthorized)
+			return
+		}
+		plain, plainName, err := decryptArchive(file, archive)
+		if err != nil {
+			log.Println("decryptArchive() :", err)
+			http.Error(w, "", http.StatusInternalServerError)
+			return
+		}
+		w.Header().Set("Content-Disposition", `attachment; filename="`+plainName+`"`)
+		http.ServeContent(w, req, plainName, modTime, bytes.NewReader(plain))
+		return
 	}
+	http.ServeContent(w, req, file, modTime, archive)
 }
 
-// DelZip handles requests to /del/ and deletes .zip files from the
-// globalConfig.ZipPageURI directory
+// DelZip handles requests to /del/ and deletes archives from globalStore
 func delZipServer(w http.ResponseWriter, req *http.Request) {
 	file := fileNameFromURL(req.URL.Path)
 
@@ -109,8 +183,8 @@ func delZipServer(w http.ResponseWriter, req *http.Request) {
 		return
 	}
 
-	if filepath.Ext(file) == ".zip" && ref.Host == globalConfig.ZipPageURI {
-		os.Remove(globalConfig.ZipsDir + file)
+	if ref.Host == globalConfig.ZipPageURI {
+		globalStore.Delete(file)
 		http.Redirect(w, req, req.Referer(), http.StatusSeeOther)
 	} else {
 		http.Error(w, "", http.StatusInternalServerError)
@@ -0,0 +1,138 @@
+package main
+
+import (
+	"log"
+	"sort"
+	"strconv"
+	"time"
+)
+
+// retentionPolicy decides when archives of a domain are deleted. An archive
+// is deleted if it breaks any of the rules, oldest archives first. Reports
+// saved in SQLite are deleted by MaxAgeDays, MaxBytes (the size of their raw
+// JSON) and MaxRows.
+type retentionPolicy struct {
+	// MaxAgeDays deletes archives older than MaxAgeDays days
+	MaxAgeDays int64
+	// MaxBytes deletes the oldest archives until all archives of the domain
+	// take up at most MaxBytes
+	MaxBytes int64
+	// MaxArchives deletes the oldest archives until at most MaxArchives are
+	// left
+	MaxArchives int
+	// MaxRows deletes the oldest reports of the domain in SQLite until at
+	// most MaxRows are left
+	MaxRows int64
+	// DryRun only logs what would be deleted
+	DryRun bool
+}
+
+// retentionPolicyFor returns the retention policy for domain name, "*" in
+// Retention applies to all domains without their own policy
+func retentionPolicyFor(name string) retentionPolicy {
+	policy, ok := globalConfig.Retention[name]
+	if !ok {
+		policy = globalConfig.Retention["*"]
+	}
+	return policy
+}
+
+// enforceRetention deletes the archives of d that break policy every hour.
+// Note that enforceRetention will not return so call it in a new gorutine.
+func (d *domain) enforceRetention(policy retentionPolicy) {
+	ticker := time.NewTicker(time.Hour)
+	for {
+		d.applyRetention(policy)
+		<-ticker.C
+	}
+}
+
+// applyRetention deletes the archives and SQLite reports of d that break
+// policy
+func (d *domain) applyRetention(policy retentionPolicy) {
+	d.applyArchiveRetention(policy)
+	if globalSQLite != nil {
+		d.applySQLiteRetention(policy)
+	}
+}
+
+// applyArchiveRetention deletes the archives of d that break policy
+func (d *domain) applyArchiveRetention(policy retentionPolicy) {
+	list, err := globalStore.List(d.name)
+	if err != nil {
+		log.Println("Store.List() :", err)
+		return
+	}
+	// Newest archive first
+	sort.Slice(list, func(i, j int) bool {
+		return list[i].ModTime.After(list[j].ModTime)
+	})
+
+	var total int64
+	for i, archive := range list {
+		total += archive.Bytes
+		var reason string
+		switch {
+		case policy.MaxAgeDays > 0 && time.Since(archive.ModTime) > time.Duration(policy.MaxAgeDays)*time.Hour*24:
+			reason = "older than MaxAgeDays"
+		case policy.MaxArchives > 0 && i >= policy.MaxArchives:
+			reason = "more than MaxArchives"
+		case policy.MaxBytes > 0 && total > policy.MaxBytes:
+			reason = "more than MaxBytes"
+		default:
+			continue
+		}
+
+		if policy.DryRun {
+			log.Println("Retention dry run, would delete", archive.FileName, ":", reason)
+			continue
+		}
+		err = globalStore.Delete(archive.FileName)
+		if err != nil {
+			log.Println("Store.Delete() :", err)
+			continue
+		}
+		if !globalConfig.Silent {
+			log.Println("Retention deleted", archive.FileName, ":", reason)
+		}
+		if globalConfig.Syslog != "" {
+			sendSyslog(syslogMessage{
+				Tag:      d.name,
+				Domain:   d.name,
+				Severity: LOG_WARNING,
+				MsgID:    "retention",
+				Params:   []syslogParam{{"domain", d.name}, {"archive", archive.FileName}},
+				Msg:      "Retention deleted archive " + archive.FileName + " from Domain " + d.name + " : " + reason,
+			})
+		}
+	}
+}
+
+// applySQLiteRetention deletes the reports of d in globalSQLite that break
+// policy
+func (d *domain) applySQLiteRetention(policy retentionPolicy) {
+	deleted, err := globalSQLite.applyRetention(d.name, policy, time.Now())
+	if err != nil {
+		log.Println("sqliteStore.applyRetention() :", err)
+	}
+	for _, rule := range deleted {
+		if policy.DryRun {
+			log.Println("Retention dry run, would delete", rule.reports, "reports of", d.name, "from SQLite :", rule.reason)
+			continue
+		}
+		if !globalConfig.Silent {
+			log.Println("Retention deleted", rule.reports, "reports of", d.name, "from SQLite :", rule.reason)
+		}
+		if globalConfig.Syslog != "" {
+			reports := strconv.FormatInt(rule.reports, 10)
+			sendSyslog(syslogMessage{
+				Tag:      d.name,
+				Domain:   d.name,
+				Severity: LOG_WARNING,
+				MsgID:    "retention",
+				Params:   []syslogParam{{"domain", d.name}, {"reports", reports}},
+				Msg:      "Retention deleted " + reports + " reports from Domain " + d.name + " in SQLite : " + rule.reason,
+			})
+		}
+	}
+}
@@ -0,0 +1,95 @@
+package main
+
+import (
+	"time"
+)
+
+// rotationPolicy decides when the pending reports of a domain are flushed to
+// a new archive, in addition to MaxReportsPerZip. Whichever rule is met
+// first triggers the flush.
+type rotationPolicy struct {
+	// Interval is "hourly" or "daily" to flush at every wall-clock hour or
+	// midnight
+	Interval string
+	// MaxBytes flushes when the compressed pending reports exceed MaxBytes.
+	// The compressor buffers its input so archives can end up some kB larger.
+	MaxBytes int64
+	// MaxAge flushes when the oldest pending report is MaxAge seconds old
+	MaxAge int64
+}
+
+// rotationPolicyFor returns the rotation policy for domain name, "*" in
+// Rotation applies to all domains without their own policy
+func rotationPolicyFor(name string) rotationPolicy {
+	policy, ok := globalConfig.Rotation[name]
+	if !ok {
+		policy = globalConfig.Rotation["*"]
+	}
+	return policy
+}
+
+// periodStart returns the start of the hour or day t is in
+func periodStart(t time.Time, interval string) time.Time {
+	switch interval {
+	case "hourly":
+		return time.Date(t.Year(), t.Month(), t.Day(), t.Hour(), 0, 0, 0, t.Location())
+	case "daily":
+		return time.Date(t.Year(), t.Month(), t.Day(), 0, 0, 0, 0, t.Location())
+	}
+	return time.Time{}
+}
+
+// nextPeriod returns the start of the hour or day after the one starting at
+// start
+func nextPeriod(start time.Time, interval string) time.Time {
+	if interval == "hourly" {
+		return start.Add(time.Hour)
+	}
+	return start.AddDate(0, 0, 1)
+}
+
+// rotateOnSchedule flushes d at the wall-clock boundaries of policy.Interval
+// and when its oldest pending report is older than policy.MaxAge.
+// Note that rotateOnSchedule will not return so call it in a new gorutine.
+func (d *domain) rotateOnSchedule(policy rotationPolicy) {
+	maxAge := time.Duration(policy.MaxAge) * time.Second
+	period := periodStart(time.Now(), policy.Interval)
+	for {
+		// Wake up at least once a minute, or once every MaxAge if that is
+		// shorter, to pick up new reports
+		wake := time.Now().Add(time.Minute)
+		if maxAge > 0 && maxAge < time.Minute {
+			wake = time.Now().Add(maxAge)
+		}
+		if policy.Interval != "" {
+			if next := nextPeriod(period, policy.Interval); next.Before(wake) {
+				wake = next
+			}
+		}
+		d.mutex.Lock()
+		if maxAge > 0 && d.nr > 0 {
+			if due := d.oldest.Add(maxAge); due.Before(wake) {
+				wake = due
+			}
+		}
+		d.mutex.Unlock()
+		time.Sleep(time.Until(wake))
+
+		now := time.Now()
+		flush := false
+		if policy.Interval != "" {
+			if start := periodStart(now, policy.Interval); !start.Equal(period) {
+				period = start
+				flush = true
+			}
+		}
+		d.mutex.Lock()
+		if maxAge > 0 && d.nr > 0 && now.Sub(d.oldest) >= maxAge {
+			flush = true
+		}
+		d.mutex.Unlock()
+		if flush {
+			d.flush()
+		}
+	}
+}
@@ -0,0 +1,213 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"log"
+	"time"
+)
+
+const (
+	// spikeWarmup is the number of intervals a baseline needs before it is
+	// used for Deviation alerts
+	spikeWarmup = 5
+	// spikeMinBaseline is the lowest baseline used for Deviation alerts, and
+	// baselines of directives that drop below it are forgotten
+	spikeMinBaseline = 1.0
+	// maxSpikeAlerts is the number of recent alerts shown on the domain page
+	maxSpikeAlerts = 25
+)
+
+// spikePolicy decides when a burst of reports to a domain, or to a single
+// directive of it, is alerted. Reports are counted per Interval and an alert
+// fires if any of the rules is broken.
+type spikePolicy struct {
+	// Interval is the number of seconds reports are counted (default 60)
+	Interval int64
+	// MaxRate alerts when more than MaxRate reports arrive in an Interval
+	MaxRate int64
+	// Deviation alerts when more than Deviation times the baseline, an
+	// exponentially weighted moving average of earlier intervals, arrive in
+	// an Interval
+	Deviation float64
+	// Alpha is the weight of the latest interval in the baseline (default
+	// 0.1)
+	Alpha float64
+	// MinReports is the fewest reports in an Interval that can break
+	// Deviation (default 10)
+	MinReports int64
+}
+
+// spikePolicyFor returns the spike policy for domain name, "*" in
+// SpikeAlerts applies to all domains without their own policy
+func spikePolicyFor(name string) spikePolicy {
+	policy, ok := globalConfig.SpikeAlerts[name]
+	if !ok {
+		policy = globalConfig.SpikeAlerts["*"]
+	}
+	if policy.Interval == 0 {
+		policy.Interval = 60
+	}
+	if policy.Alpha == 0 {
+		policy.Alpha = 0.1
+	}
+	if policy.MinReports == 0 {
+		policy.MinReports = 10
+	}
+	return policy
+}
+
+// baseline is the EWMA of the number of reports per interval
+type baseline struct {
+	rate      float64
+	intervals int
+}
+
+// rateTracker counts the reports of a domain, in total and per directive
+// (or report type for other reports), and keeps their baselines
+type rateTracker struct {
+	total       int64
+	directives  counter
+	baseline    baseline
+	byDirective map[string]*baseline
+	// alerts are the most recent alerts, newest first
+	alerts []spikeAlert
+}
+
+func newRateTracker() *rateTracker {
+	return &rateTracker{directives: make(counter), byDirective: make(map[string]*baseline)}
+}
+
+// add counts a report to directive
+func (t *rateTracker) add(directive string) {
+	t.total++
+	addLimited(t.directives, directive)
+}
+
+// spikeAlert is logged and sent to syslog and SpikeWebhook for every broken
+// spikePolicy rule
+type spikeAlert struct {
+	Domain string `json:"domain"`
+	// Directive is empty for alerts on all reports of Domain
+	Directive string    `json:"directive,omitempty"`
+	Reports   int64     `json:"reports"`
+	Interval  int64     `json:"interval"`
+	Baseline  float64   `json:"baseline"`
+	Reason    string    `json:"reason"`
+	Time      time.Time `json:"time"`
+}
+
+// check compares n reports in the last interval to policy and b, returns
+// the reason if a rule is broken and updates b
+func (b *baseline) check(n int64, policy spikePolicy) (reason string) {
+	switch {
+	case policy.MaxRate > 0 && n > policy.MaxRate:
+		reason = fmt.Sprintf("more than MaxRate %d", policy.MaxRate)
+	case policy.Deviation > 0 && b.intervals >= spikeWarmup && n >= policy.MinReports && float64(n) > policy.Deviation*maxFloat(b.rate, spikeMinBaseline):
+		reason = fmt.Sprintf("%.1f times the baseline", float64(n)/maxFloat(b.rate, spikeMinBaseline))
+	}
+	if b.intervals == 0 {
+		b.rate = float64(n)
+	} else {
+		b.rate = policy.Alpha*float64(n) + (1-policy.Alpha)*b.rate
+	}
+	b.intervals++
+	return reason
+}
+
+func maxFloat(a, b float64) float64 {
+	if a > b {
+		return a
+	}
+	return b
+}
+
+// checkSpikes checks the rates of d against policy at the end of every
+// interval and alerts on spikes. All spikes are listed on the domain page,
+// only those allowed by d.alerts are sent.
+// Note that checkSpikes will not return so call it in a new gorutine.
+func (d *domain) checkSpikes(policy spikePolicy) {
+	ticker := time.NewTicker(time.Duration(policy.Interval) * time.Second)
+	for now := range ticker.C {
+		d.mutex.Lock()
+		t := d.rates
+		var alerts []spikeAlert
+		alert := func(directive string, n int64, b *baseline) {
+			before := b.rate
+			if reason := b.check(n, policy); reason != "" {
+				alerts = append(alerts, spikeAlert{
+					Domain:    d.name,
+					Directive: directive,
+					Reports:   n,
+					Interval:  policy.Interval,
+					Baseline:  before,
+					Reason:    reason,
+					Time:      now.UTC(),
+				})
+			}
+		}
+
+		alert("", t.total, &t.baseline)
+		for directive, n := range t.directives {
+			b, ok := t.byDirective[directive]
+			if !ok {
+				b = new(baseline)
+				t.byDirective[directive] = b
+			}
+			alert(directive, n, b)
+		}
+		// Directives without reports in this interval decay towards zero
+		for directive, b := range t.byDirective {
+			if _, ok := t.directives[directive]; ok {
+				continue
+			}
+			b.check(0, policy)
+			if b.rate < spikeMinBaseline && b.intervals >= spikeWarmup {
+				delete(t.byDirective, directive)
+			}
+		}
+		t.total = 0
+		t.directives = make(counter)
+
+		var send []spikeAlert
+		for _, a := range alerts {
+			t.alerts = append([]spikeAlert{a}, t.alerts...)
+			if d.alerts.allow(now) {
+				send = append(send, a)
+			}
+		}
+		if len(t.alerts) > maxSpikeAlerts {
+			t.alerts = t.alerts[:maxSpikeAlerts]
+		}
+		d.mutex.Unlock()
+
+		for _, a := range send {
+			sendSpikeAlert(a)
+		}
+	}
+}
+
+// sendSpikeAlert logs a and sends it to syslog and SpikeWebhook
+func sendSpikeAlert(a spikeAlert) {
+	body, err := json.Marshal(a)
+	if err != nil {
+		log.Println("json.Marshal() :", err)
+		return
+	}
+	if !globalConfig.Silent {
+		log.Println("Report spike on Domain", a.Domain, ":", string(body))
+	}
+	if globalConfig.Syslog != "" {
+		sendSyslog(syslogMessage{
+			Tag:      a.Domain,
+			Domain:   a.Domain,
+			Severity: globalSyslogAlertSeverity,
+			MsgID:    "spike",
+			Params:   []syslogParam{{"domain", a.Domain}, {"directive", a.Directive}},
+			Msg:      "Report spike on Domain " + a.Domain + " : " + string(body),
+		})
+	}
+	if globalConfig.SpikeWebhook != "" {
+		queueWebhook(globalConfig.SpikeWebhook, body)
+	}
+}
@@ -0,0 +1,342 @@
+package main
+
+import (
+	"database/sql"
+	"io"
+	"time"
+
+	_ "modernc.org/sqlite" // Pure Go SQLite driver registered as "sqlite"
+)
+
+// sqliteSchema creates the reports table with one column per report field
+const sqliteSchema = `
+CREATE TABLE IF NOT EXISTS reports (
+	id                  INTEGER PRIMARY KEY,
+	domain              TEXT NOT NULL,
+	time                INTEGER NOT NULL,
+	type                TEXT NOT NULL,
+	document_uri        TEXT,
+	blocked_uri         TEXT,
+	effective_directive TEXT,
+	violated_directive  TEXT,
+	original_policy     TEXT,
+	referrer            TEXT,
+	script_sample       TEXT,
+	source_file         TEXT,
+	line_number         INTEGER,
+	column_number       INTEGER,
+	disposition         TEXT,
+	status_code         INTEGER,
+	raw                 TEXT NOT NULL,
+	trusted_types_sink    TEXT,
+	trusted_types_payload TEXT,
+	directive             TEXT
+);
+CREATE INDEX IF NOT EXISTS reports_domain ON reports (domain);
+CREATE INDEX IF NOT EXISTS reports_time ON reports (time);
+CREATE INDEX IF NOT EXISTS reports_effective_directive ON reports (effective_directive);
+CREATE INDEX IF NOT EXISTS reports_blocked_uri ON reports (blocked_uri);
+`
+
+const sqliteInsert = `
+INSERT INTO reports (
+	domain, time, type, document_uri, blocked_uri, effective_directive,
+	violated_directive, original_policy, referrer, script_sample, source_file,
+	line_number, column_number, disposition, status_code, raw,
+	trusted_types_sink, trusted_types_payload, directive
+) VALUES (?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?)`
+
+// sqliteColumns are added to reports tables created before they existed.
+// Fill, if set, is the value given to the rows already in the table.
+var sqliteColumns = []struct {
+	name string
+	fill string
+}{
+	{name: "trusted_types_sink"},
+	{name: "trusted_types_payload"},
+	{name: "directive", fill: sqliteDirective},
+}
+
+// sqliteIndexes are created once all sqliteColumns exist. The directive
+// filter of Query reads the reports of one domain in id order.
+const sqliteIndexes = `
+CREATE INDEX IF NOT EXISTS reports_directive ON reports (domain, directive, id);
+`
+
+// sqliteStore is a Store that saves every report as a row in an SQLite
+// database. Reports are written as they arrive so there is nothing to rotate
+// and no archives to list.
+type sqliteStore struct {
+	db     *sql.DB
+	insert *sql.Stmt
+}
+
+func newSQLiteStore(path string) (*sqliteStore, error) {
+	db, err := sql.Open("sqlite", path)
+	if err != nil {
+		return nil, err
+	}
+	// SQLite only allows one writer at a time
+	db.SetMaxOpenConns(1)
+
+	_, err = db.Exec(sqliteSchema)
+	if err != nil {
+		db.Close()
+		return nil, err
+	}
+	for _, column := range sqliteColumns {
+		var n int
+		err = db.QueryRow("SELECT COUNT(*) FROM pragma_table_info('reports') WHERE name = ?", column.name).Scan(&n)
+		if err == nil && n == 0 {
+			_, err = db.Exec("ALTER TABLE reports ADD COLUMN " + column.name + " TEXT")
+			if err == nil && column.fill != "" {
+				_, err = db.Exec("UPDATE reports SET " + column.name + " = " + column.fill)
+			}
+		}
+		if err != nil {
+			db.Close()
+			return nil, err
+		}
+	}
+	_, err = db.Exec(sqliteIndexes)
+	if err != nil {
+		db.Close()
+		return nil, err
+	}
+	insert, err := db.Prepare(sqliteInsert)
+	if err != nil {
+		db.Close()
+		return nil, err
+	}
+	return &sqliteStore{db: db, insert: insert}, nil
+}
+
+// Append inserts rec into the reports table. For reports other than CSP
+// violations only domain, time, type, document_uri and raw are set. The sink
+// and payload of Trusted Types violations are set on the CSP violation row.
+func (s *sqliteStore) Append(domain string, rec record) error {
+	if rec.Type == reportTypeTrustedTypes {
+		// Parsed from script_sample, no need to save it twice
+		return nil
+	}
+	if rec.Replayed {
+		// Inserted before the journal was replayed
+		return nil
+	}
+	r := rec.Report
+	if r == nil {
+		r = &report{DocumentURI: rec.URL}
+	}
+	_, err := s.insert.Exec(
+		domain, rec.Time.Unix(), rec.Type, r.DocumentURI, r.BlockedURI, r.EffectiveDirective,
+		r.ViolatedDirective, r.OriginalPolicy, r.Referrer, r.ScriptSample, r.SourceFile,
+		r.LineNumber, r.ColumnNumber, r.Disposition, r.StatusCode, string(rec.Raw),
+		r.TrustedTypesSink, r.TrustedTypesPayload, rec.directive(),
+	)
+	return err
+}
+
+// sqliteDirective computes the directive column of rows inserted before it
+// existed, it matches record.directive
+const sqliteDirective = `CASE WHEN type = 'csp-violation'
+	THEN COALESCE(NULLIF(effective_directive, ''), violated_directive)
+	ELSE type END`
+
+// Query returns the ids and reports of at most max rows of domain after the
+// row afterID that match filter, in the order they were inserted. Reports get
+// the time saved in their row.
+func (s *sqliteStore) Query(domain string, afterID int64, filter reportFilter, max int) (ids []int64, records []record, err error) {
+	query := "SELECT id, time, raw FROM reports WHERE domain = ? AND id > ?"
+	args := []interface{}{domain, afterID}
+	if filter.directive != "" {
+		query += " AND directive = ?"
+		args = append(args, filter.directive)
+	}
+	if filter.blocked != "" {
+		query += " AND instr(blocked_uri, ?) > 0"
+		args = append(args, filter.blocked)
+	}
+	// Times are saved in whole seconds
+	if !filter.from.IsZero() {
+		from := filter.from.Unix()
+		if filter.from.Nanosecond() > 0 {
+			from++
+		}
+		query += " AND time >= ?"
+		args = append(args, from)
+	}
+	if !filter.to.IsZero() {
+		query += " AND time <= ?"
+		args = append(args, filter.to.Unix())
+	}
+	query += " ORDER BY id LIMIT ?"
+	args = append(args, max)
+
+	// Read all rows before returning so that inserts are not blocked while
+	// the reports are sent
+	rows, err := s.db.Query(query, args...)
+	if err != nil {
+		return nil, nil, err
+	}
+	defer rows.Close()
+	for rows.Next() {
+		var id, t int64
+		var raw string
+		err = rows.Scan(&id, &t, &raw)
+		if err != nil {
+			return nil, nil, err
+		}
+		parsed, err := parseStoredReports([]byte(raw))
+		if err != nil || len(parsed) != 1 {
+			continue // Skip if errors
+		}
+		rec := parsed[0]
+		rec.Time = time.Unix(t, 0)
+		ids = append(ids, id)
+		records = append(records, rec)
+	}
+	return ids, records, rows.Err()
+}
+
+// sqliteRetentionDeleted is the number of reports deleted by a retention
+// rule
+type sqliteRetentionDeleted struct {
+	reason  string
+	reports int64
+}
+
+// applyRetention deletes the reports of domain that break policy at now,
+// oldest first, and returns the number of reports deleted by each rule. If
+// policy.DryRun is set the reports that would be deleted are only counted.
+func (s *sqliteStore) applyRetention(domain string, policy retentionPolicy, now time.Time) (deleted []sqliteRetentionDeleted, err error) {
+	type rule struct {
+		reason string
+		where  string
+		args   []interface{}
+	}
+	var rules []rule
+	if policy.MaxAgeDays > 0 {
+		rules = append(rules, rule{"older than MaxAgeDays", "time < ?",
+			[]interface{}{now.Add(-time.Duration(policy.MaxAgeDays) * 24 * time.Hour).Unix()}})
+	}
+	if policy.MaxRows > 0 {
+		// The newest row that is too many and all older ones
+		rules = append(rules, rule{"more than MaxRows",
+			"id <= (SELECT id FROM reports WHERE domain = ? ORDER BY id DESC LIMIT 1 OFFSET ?)",
+			[]interface{}{domain, policy.MaxRows}})
+	}
+	if policy.MaxBytes > 0 {
+		// The newest row that does not fit in MaxBytes and all older ones
+		rules = append(rules, rule{"more than MaxBytes",
+			`id <= (SELECT id FROM (
+				SELECT id, SUM(length(raw)) OVER (ORDER BY id DESC) AS total FROM reports WHERE domain = ?
+			) WHERE total > ? ORDER BY id DESC LIMIT 1)`,
+			[]interface{}{domain, policy.MaxBytes}})
+	}
+
+	for _, r := range rules {
+		args := append([]interface{}{domain}, r.args...)
+		var n int64
+		if policy.DryRun {
+			err = s.db.QueryRow("SELECT COUNT(*) FROM reports WHERE domain = ? AND "+r.where, args...).Scan(&n)
+		} else {
+			var result sql.Result
+			result, err = s.db.Exec("DELETE FROM reports WHERE domain = ? AND "+r.where, args...)
+			if err == nil {
+				n, err = result.RowsAffected()
+			}
+		}
+		if err != nil {
+			return deleted, err
+		}
+		if n > 0 {
+			deleted = append(deleted, sqliteRetentionDeleted{reason: r.reason, reports: n})
+		}
+	}
+	return deleted, nil
+}
+
+func (s *sqliteStore) Rotate(domain string) error {
+	return nil
+}
+
+func (s *sqliteStore) Size(domain string) int64 {
+	return 0
+}
+
+func (s *sqliteStore) List(domain string) ([]zipInfo, error) {
+	return nil, nil
+}
+
+func (s *sqliteStore) Open(name string) (io.ReadSeekCloser, time.Time, error) {
+	return nil, time.Time{}, errNotArchive
+}
+
+func (s *sqliteStore) Delete(name string) error {
+	return errNotArchive
+}
+
+func (s *sqliteStore) Records(name string, fn func(rec record) error) error {
+	return errNotArchive
+}
+
+func (s *sqliteStore) Pending(domain string) func(fn func(rec record) error) error {
+	return func(fn func(rec record) error) error {
+		return nil
+	}
+}
+
+// multiStore writes reports to several stores, e.g. both zip files and
+// SQLite. Archives are listed, opened and deleted from the first store.
+type multiStore []Store
+
+func (m multiStore) Append(domain string, rec record) error {
+	for _, s := range m {
+		err := s.Append(domain, rec)
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (m multiStore) Rotate(domain string) error {
+	for _, s := range m {
+		err := s.Rotate(domain)
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// Size returns the largest size of the pending reports of domain in any of
+// the stores
+func (m multiStore) Size(domain string) (size int64) {
+	for _, s := range m {
+		if n := s.Size(domain); n > size {
+			size = n
+		}
+	}
+	return size
+}
+
+func (m multiStore) List(domain string) ([]zipInfo, error) {
+	return m[0].List(domain)
+}
+
+func (m multiStore) Open(name string) (io.ReadSeekCloser, time.Time, error) {
+	return m[0].Open(name)
+}
+
+func (m multiStore) Delete(name string) error {
+	return m[0].Delete(name)
+}
+
+func (m multiStore) Records(name string, fn func(rec record) error) error {
+	return m[0].Records(name, fn)
+}
+
+func (m multiStore) Pending(domain string) func(fn func(rec record) error) error {
+	return m[0].Pending(domain)
+}
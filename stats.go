@@ -0,0 +1,293 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// CSP violations are counted per window of statsWindows, in one bucket per
+// point of its series
+const (
+	// statsMaxKeys limits the number of keys of each kind counted in all
+	// windows, the rest are counted as statsOtherKey
+	statsMaxKeys  = 1000
+	statsOtherKey = "(other)"
+	// statsMaxKeyLen is the longest key counted, longer keys are truncated
+	statsMaxKeyLen = 256
+	// statsTopRows is the number of rows in each table of violationStats
+	statsTopRows = 25
+)
+
+// Kinds of keys counted in statsBucketCounts
+const (
+	statsDirectives = iota
+	statsOrigins
+	statsPaths
+	statsSources
+	statsKinds
+)
+
+// statsWindows are the windows that can be selected on /api/stats/, with the
+// number of points in their series
+var statsWindows = map[string]struct {
+	window time.Duration
+	points int
+}{
+	"1h":  {time.Hour, 6},
+	"24h": {24 * time.Hour, 24},
+	"7d":  {7 * 24 * time.Hour, 28},
+}
+
+// statsBucketCounts holds the violations counted during one bucket
+type statsBucketCounts struct {
+	start time.Time
+	total int64
+	// keys holds the counts of each kind of key
+	keys [statsKinds]counter
+}
+
+// statsSeries holds the buckets of one window, a bucket is reused once it
+// is older than the window
+type statsSeries struct {
+	window  time.Duration
+	step    time.Duration
+	buckets []*statsBucketCounts
+}
+
+// rollingStats counts CSP violations over every window of statsWindows
+type rollingStats struct {
+	series map[string]*statsSeries
+	// keys holds the number of buckets counting each key, by kind
+	keys [statsKinds]map[string]int
+}
+
+func newRollingStats() *rollingStats {
+	s := &rollingStats{series: make(map[string]*statsSeries)}
+	for name, w := range statsWindows {
+		s.series[name] = &statsSeries{
+			window:  w.window,
+			step:    w.window / time.Duration(w.points),
+			buckets: make([]*statsBucketCounts, w.points),
+		}
+	}
+	for kind := range s.keys {
+		s.keys[kind] = make(map[string]int)
+	}
+	return s
+}
+
+// bucket returns the bucket of series counting violations at t, or nil if
+// t is older than the buckets kept
+func (s *rollingStats) bucket(series *statsSeries, t time.Time) *statsBucketCounts {
+	start := t.Truncate(series.step)
+	i := int(start.Unix()/int64(series.step/time.Second)) % len(series.buckets)
+	b := series.buckets[i]
+	if b != nil && b.start.Equal(start) {
+		return b
+	}
+	if b != nil && b.start.After(start) {
+		return nil
+	}
+
+	// Release every bucket that is out of the window, not only the one
+	// reused, so that their keys are no longer counted against statsMaxKeys
+	from := start.Add(series.step - series.window)
+	for j, old := range series.buckets {
+		if old != nil && old.start.Before(from) {
+			s.release(old)
+			series.buckets[j] = nil
+		}
+	}
+	b = &statsBucketCounts{start: start}
+	for kind := range b.keys {
+		b.keys[kind] = make(counter)
+	}
+	series.buckets[i] = b
+	return b
+}
+
+// release forgets the keys counted in b when no other bucket counts them
+func (s *rollingStats) release(b *statsBucketCounts) {
+	for kind, c := range b.keys {
+		for key := range c {
+			s.keys[kind][key]--
+			if s.keys[kind][key] <= 0 {
+				delete(s.keys[kind], key)
+			}
+		}
+	}
+}
+
+// limitKey truncates key to statsMaxKeyLen bytes
+func limitKey(key string) string {
+	if len(key) <= statsMaxKeyLen {
+		return key
+	}
+	// Copy the key so that it does not keep the whole value in memory, and
+	// drop a rune that was cut in half
+	return strings.ToValidUTF8(strings.Clone(key[:statsMaxKeyLen]), "")
+}
+
+// addLimited counts key, truncated by limitKey, in c unless c already holds
+// statsMaxKeys keys
+func addLimited(c counter, key string) {
+	key = limitKey(key)
+	if _, ok := c[key]; !ok && len(c) >= statsMaxKeys {
+		key = statsOtherKey
+	}
+	c.add(key)
+}
+
+// add counts the CSP violation r received at t
+func (s *rollingStats) add(r *report, t time.Time) {
+	var keys [statsKinds]string
+	keys[statsDirectives] = r.EffectiveDirective
+	if keys[statsDirectives] == "" {
+		keys[statsDirectives] = r.ViolatedDirective
+	}
+	keys[statsOrigins] = uriOrigin(r.BlockedURI)
+	keys[statsPaths] = statsOtherKey
+	if u, err := url.Parse(r.DocumentURI); err == nil {
+		keys[statsPaths] = u.Path
+	}
+	keys[statsSources] = stripQuery(r.SourceFile)
+	for kind, key := range keys {
+		key = limitKey(key)
+		if _, ok := s.keys[kind][key]; !ok && len(s.keys[kind]) >= statsMaxKeys {
+			key = statsOtherKey
+		}
+		keys[kind] = key
+	}
+
+	for _, series := range s.series {
+		b := s.bucket(series, t)
+		if b == nil {
+			continue
+		}
+		b.total++
+		for kind, key := range keys {
+			if _, ok := b.keys[kind][key]; !ok {
+				s.keys[kind][key]++
+			}
+			b.keys[kind].add(key)
+		}
+	}
+}
+
+// uriOrigin returns the scheme and host of uri, or uri itself for values
+// like inline and eval
+func uriOrigin(uri string) string {
+	u, err := url.Parse(uri)
+	if err != nil || u.Host == "" {
+		return uri
+	}
+	return u.Scheme + "://" + u.Host
+}
+
+// violationStats is returned by /api/stats/ and shown on the domain page
+type violationStats struct {
+	Domain         string     `json:"domain"`
+	Window         string     `json:"window"`
+	Total          int64      `json:"total"`
+	Directives     []keyCount `json:"directives"`
+	BlockedOrigins []keyCount `json:"blocked_origins"`
+	DocumentPaths  []keyCount `json:"document_paths"`
+	SourceFiles    []keyCount `json:"source_files"`
+	// Series holds the number of violations in equal parts of the window,
+	// oldest first
+	Series []int64 `json:"series"`
+}
+
+// summary returns the violations counted in the window before now
+func (s *rollingStats) summary(window string, now time.Time) violationStats {
+	w := statsWindows[window]
+	series := s.series[window]
+	stats := violationStats{Window: window, Series: make([]int64, w.points)}
+	var counts [statsKinds]counter
+	for kind := range counts {
+		counts[kind] = make(counter)
+	}
+
+	from := now.Truncate(series.step).Add(series.step - w.window)
+	for _, b := range series.buckets {
+		if b == nil || b.start.Before(from) || b.start.After(now) {
+			continue
+		}
+		stats.Total += b.total
+		point := int(b.start.Sub(from) / series.step)
+		if point >= 0 && point < len(stats.Series) {
+			stats.Series[point] += b.total
+		}
+		for kind, c := range b.keys {
+			for key, count := range c {
+				counts[kind][key] += count
+			}
+		}
+	}
+	stats.Directives = counts[statsDirectives].top(statsTopRows)
+	stats.BlockedOrigins = counts[statsOrigins].top(statsTopRows)
+	stats.DocumentPaths = counts[statsPaths].top(statsTopRows)
+	stats.SourceFiles = counts[statsSources].top(statsTopRows)
+	return stats
+}
+
+// sparkline returns the points of an SVG polyline of width x height drawing
+// series
+func sparkline(series []int64, width, height int) string {
+	var max int64 = 1
+	for _, v := range series {
+		if v > max {
+			max = v
+		}
+	}
+	var points strings.Builder
+	for i, v := range series {
+		x := 0
+		if len(series) > 1 {
+			x = i * width / (len(series) - 1)
+		}
+		y := height - int(v*int64(height)/max)
+		if i > 0 {
+			points.WriteByte(' ')
+		}
+		points.WriteString(strconv.Itoa(x) + "," + strconv.Itoa(y))
+	}
+	return points.String()
+}
+
+// statsAPIServer handles requests to /api/stats/<domain>?window=1h|24h|7d
+// and returns violationStats as JSON, the default window is 24h. Like
+// /api/reports it is served to the zip page and to APIUsers.
+func statsAPIServer(w http.ResponseWriter, req *http.Request) {
+	if !apiAllowed(req) {
+		w.Header().Set("WWW-Authenticate", `Basic realm="cspreporter API"`)
+		http.Error(w, "", http.StatusUnauthorized)
+		return
+	}
+	name := strings.Trim(strings.TrimPrefix(req.URL.Path, "/api/stats/"), "/")
+	d, ok := globalDomainMap[name]
+	if !ok {
+		http.NotFound(w, req)
+		return
+	}
+	window := req.URL.Query().Get("window")
+	if window == "" {
+		window = "24h"
+	}
+	if _, ok := statsWindows[window]; !ok {
+		http.Error(w, "window must be 1h, 24h or 7d", http.StatusBadRequest)
+		return
+	}
+
+	d.mutex.Lock()
+	stats := d.stats.summary(window, time.Now())
+	d.mutex.Unlock()
+	stats.Domain = name
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(stats)
+}
@@ -0,0 +1,585 @@
+package main
+
+import (
+	"archive/zip"
+	"bufio"
+	"bytes"
+	"compress/flate"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"hash"
+	"hash/crc32"
+	"io"
+	"io/ioutil"
+	"os"
+	"path"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Store saves the reports of each domain until they are rotated into an
+// archive, and gives access to the archives.
+// Append and Rotate are called with the mutex of the domain held.
+type Store interface {
+	// Append adds rec to the pending reports of domain
+	Append(domain string, rec record) error
+	// Rotate moves all pending reports of domain into a new archive
+	Rotate(domain string) error
+	// Size returns the number of bytes the pending reports of domain will
+	// take up in the archive
+	Size(domain string) int64
+	// List returns all archives of domain
+	List(domain string) ([]zipInfo, error)
+	// Open returns the content and modification time of archive name
+	Open(name string) (io.ReadSeekCloser, time.Time, error)
+	// Delete removes archive name
+	Delete(name string) error
+	// Records calls fn for every report in archive name, an error from fn
+	// stops the scan and is returned
+	Records(name string, fn func(rec record) error) error
+	// Pending copies the pending reports of domain and returns a function
+	// that calls fn for each of them, an error from fn stops the scan and is
+	// returned. Pending is cheap enough to call with the domain locked, the
+	// reports are decoded by the returned function.
+	Pending(domain string) func(fn func(rec record) error) error
+}
+
+// pendingLine is a line of the next archive of a domain. The lines are kept
+// in memory until the archive is written so that they can be read without
+// decompressing the archive.
+type pendingLine struct {
+	raw  []byte
+	time time.Time
+}
+
+// errStopScan is returned by functions passed to Store.Records to stop the
+// scan early
+var errStopScan = errors.New("stop scan")
+
+// errNotArchive is returned for names that do not belong to an archive
+var errNotArchive = errors.New("not an archive")
+
+// archiveDir lists, opens and deletes the archives with extension ext in dir
+type archiveDir struct {
+	dir string
+	ext string
+}
+
+// archiveNr numbers the archives of a domain, the number starts over every
+// day
+type archiveNr struct {
+	day string
+	nr  int
+}
+
+// archiveLess reports whether archive a was created before archive b of the
+// same domain, comparing the day and then the number so that _9 comes before
+// _10
+func archiveLess(a, b string) bool {
+	return archiveSortKey(a) < archiveSortKey(b)
+}
+
+// archiveSortKey returns name with the archive number padded with zeros
+func archiveSortKey(name string) string {
+	i := strings.LastIndex(name, "_")
+	if i < 0 {
+		return name
+	}
+	j := strings.Index(name[i:], ".")
+	if j < 0 {
+		j = len(name) - i
+	}
+	nr := name[i+1 : i+j]
+	if len(nr) < 10 {
+		nr = strings.Repeat("0", 10-len(nr)) + nr
+	}
+	return name[:i+1] + nr + name[i+j:]
+}
+
+// create writes data to a new archive of domain named
+// example.com_YYYY-MM-DD_i followed by a.ext, and the extension of the
+// configured Encryption if archives are encrypted
+func (a archiveDir) create(domain string, n *archiveNr, data []byte) error {
+	data, encExt, err := encryptArchive(data)
+	if err != nil {
+		return err
+	}
+
+	today := time.Now().Format("2006-01-02")
+	if n.day != today {
+		n.day = today
+		n.nr = 0
+	}
+	name := a.dir + domain + "_" + today + "_" + strconv.Itoa(n.nr) + a.ext + encExt
+	for _, err := os.Stat(name); !os.IsNotExist(err); _, err = os.Stat(name) {
+		n.nr++
+		name = a.dir + domain + "_" + today + "_" + strconv.Itoa(n.nr) + a.ext + encExt
+	}
+	err = ioutil.WriteFile(name, data, 0644)
+	if err != nil {
+		os.Remove(name)
+	}
+	return err
+}
+
+// isArchive reports whether name is an archive with extension a.ext, either
+// plain or encrypted
+func (a archiveDir) isArchive(name string) bool {
+	name = strings.TrimSuffix(strings.TrimSuffix(name, ageExt), aesGCMExt)
+	return strings.HasSuffix(name, a.ext)
+}
+
+// List returns all archives in a.dir that start with the prefix domain
+func (a archiveDir) List(domain string) (list []zipInfo, err error) {
+	files, err := ioutil.ReadDir(a.dir)
+	if err != nil {
+		return nil, err
+	}
+
+	for _, file := range files {
+		// Only list files that has the archive extention and start with the
+		// specified domain name.
+		if a.isArchive(file.Name()) && strings.HasPrefix(file.Name(), domain+"_") {
+			list = append(list, zipInfo{
+				FileName:  file.Name(),
+				Size:      readableSize(file.Size()),
+				Bytes:     file.Size(),
+				ModTime:   file.ModTime(),
+				Encrypted: isEncrypted(file.Name()),
+			})
+		}
+	}
+	return
+}
+
+func (a archiveDir) Open(name string) (io.ReadSeekCloser, time.Time, error) {
+	if !a.isArchive(name) {
+		return nil, time.Time{}, errNotArchive
+	}
+	f, err := os.Open(a.dir + name)
+	if err != nil {
+		return nil, time.Time{}, err
+	}
+	info, err := f.Stat()
+	if err != nil {
+		f.Close()
+		return nil, time.Time{}, err
+	}
+	return f, info.ModTime(), nil
+}
+
+// read returns the decrypted content and modification time of archive name
+func (a archiveDir) read(name string) ([]byte, time.Time, error) {
+	f, modTime, err := a.Open(name)
+	if err != nil {
+		return nil, time.Time{}, err
+	}
+	defer f.Close()
+	if isEncrypted(name) {
+		data, _, err := decryptArchive(name, f)
+		return data, modTime, err
+	}
+	data, err := ioutil.ReadAll(f)
+	return data, modTime, err
+}
+
+func (a archiveDir) Delete(name string) error {
+	if !a.isArchive(name) {
+		return errNotArchive
+	}
+	return os.Remove(a.dir + name)
+}
+
+// zipStore is the default Store, it saves reports in .zip files in dir
+type zipStore struct {
+	archiveDir
+	mutex   sync.Mutex // guards pending
+	pending map[string]*pendingZip
+}
+
+// pendingZip holds the reports of a domain that are not yet saved to disk
+type pendingZip struct {
+	members map[string]*zipMember
+	fileNr  archiveNr
+
+	// Counted for summary.json
+	reports    int64
+	directives counter
+	blocked    counter
+}
+
+func newPendingZip() *pendingZip {
+	return &pendingZip{
+		members:    make(map[string]*zipMember),
+		directives: make(counter),
+		blocked:    make(counter),
+	}
+}
+
+// zipSummary is saved as summary.json in every zip
+type zipSummary struct {
+	Domain         string           `json:"domain"`
+	Reports        int64            `json:"reports"`
+	Directives     map[string]int64 `json:"directives"`
+	TopBlockedURIs []keyCount       `json:"top-blocked-uris"`
+}
+
+// maxSummaryBlockedURIs is the number of blocked URIs listed in summary.json
+const maxSummaryBlockedURIs = 20
+
+func newZipStore(dir string) *zipStore {
+	return &zipStore{archiveDir: archiveDir{dir: dir, ext: ".zip"}, pending: make(map[string]*pendingZip)}
+}
+
+// zipMember is a file in the next zip. The content is compressed as reports
+// arrive and added to the zip on rotation, since a zip.Writer only allows
+// writing to one file at a time.
+type zipMember struct {
+	data  bytes.Buffer
+	fw    *flate.Writer
+	crc   hash.Hash32
+	size  uint64
+	lines []pendingLine
+}
+
+func newZipMember() *zipMember {
+	m := new(zipMember)
+	m.fw, _ = flate.NewWriter(&m.data, flate.DefaultCompression)
+	m.crc = crc32.NewIEEE()
+	return m
+}
+
+func (m *zipMember) Write(p []byte) (int, error) {
+	n, err := m.fw.Write(p)
+	m.crc.Write(p[:n])
+	m.size += uint64(n)
+	return n, err
+}
+
+// finalBlock is an empty, final deflate block with fixed Huffman codes. It
+// ends a stream that was flushed to a byte boundary.
+var finalBlock = []byte{0x03, 0x00}
+
+// writeTo adds m as name to zw. The flate writer of m is flushed instead of
+// closed, so m can still be written to if the zip is not stored.
+func (m *zipMember) writeTo(zw *zip.Writer, name string) error {
+	err := m.fw.Flush()
+	if err != nil {
+		return err
+	}
+	header := &zip.FileHeader{
+		Name:               name,
+		Method:             zip.Deflate,
+		CRC32:              m.crc.Sum32(),
+		CompressedSize64:   uint64(m.data.Len() + len(finalBlock)),
+		UncompressedSize64: m.size,
+	}
+	f, err := zw.CreateRaw(header)
+	if err != nil {
+		return err
+	}
+	_, err = f.Write(m.data.Bytes())
+	if err != nil {
+		return err
+	}
+	_, err = f.Write(finalBlock)
+	return err
+}
+
+// get returns the pending reports of domain
+func (s *zipStore) get(domain string) *pendingZip {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	p, ok := s.pending[domain]
+	if !ok {
+		p = newPendingZip()
+		s.pending[domain] = p
+	}
+	return p
+}
+
+// memberKey holds the values ZipMemberTemplate can use to name the file in
+// the zip where a report is saved
+type memberKey struct {
+	Domain string
+	Type   string
+	// Directive is the effective directive of CSP reports and the report
+	// type of all other reports
+	Directive string
+	// Date and Hour of the report as YYYY-MM-DD and HH
+	Date string
+	Hour string
+}
+
+// directive returns the effective directive of rec, or its type if it is not
+// a CSP report
+func (rec record) directive() string {
+	if rec.Report == nil {
+		return rec.Type
+	}
+	if rec.Report.EffectiveDirective != "" {
+		return rec.Report.EffectiveDirective
+	}
+	return rec.Report.ViolatedDirective
+}
+
+// memberName returns the name of the file in the zip where rec is saved.
+// Without ZipMemberTemplate that is e.g. example.com.txt for CSP reports and
+// example.com-coep.txt for COEP reports.
+func memberName(domain string, rec record) string {
+	if globalMemberTemplate != nil {
+		name, err := executeMemberTemplate(memberKey{
+			Domain:    domain,
+			Type:      cleanMemberField(rec.Type),
+			Directive: cleanMemberField(rec.directive()),
+			Date:      rec.Time.Format("2006-01-02"),
+			Hour:      rec.Time.Format("15"),
+		})
+		if err == nil {
+			return name
+		}
+		// checkMemberTemplate accepted the template, so only values sent by
+		// a client end up here, e.g. a directive named summary.json
+	}
+	if rec.Type == reportTypeCSP {
+		return domain + ".txt"
+	}
+	return domain + "-" + rec.Type + ".txt"
+}
+
+// executeMemberTemplate returns the name globalMemberTemplate gives to the
+// file in the zip for key, relative to the root of the zip
+func executeMemberTemplate(key memberKey) (string, error) {
+	var b bytes.Buffer
+	err := globalMemberTemplate.Execute(&b, key)
+	if err != nil {
+		return "", err
+	}
+	name := strings.TrimLeft(path.Clean("/"+b.String()), "/")
+	switch name {
+	case "":
+		return "", errors.New("empty file name")
+	case "summary.json":
+		return "", errors.New("summary.json is the name of the zip summary")
+	}
+	return name, nil
+}
+
+// checkMemberTemplate returns an error if globalMemberTemplate can't name the
+// file in the zip for a report of any type
+func checkMemberTemplate() error {
+	reportTypes := []string{reportTypeTrustedTypes}
+	for reportType := range reportTypeLabels {
+		reportTypes = append(reportTypes, reportType)
+	}
+	now := time.Now()
+	for _, reportType := range reportTypes {
+		directives := []string{reportType}
+		if reportType == reportTypeCSP {
+			directives = []string{"script-src-elem", "style-src", "none"}
+		}
+		for _, directive := range directives {
+			_, err := executeMemberTemplate(memberKey{
+				Domain:    "example.com",
+				Type:      reportType,
+				Directive: directive,
+				Date:      now.Format("2006-01-02"),
+				Hour:      now.Format("15"),
+			})
+			if err != nil {
+				return fmt.Errorf("%s report : %w", reportType, err)
+			}
+		}
+	}
+	return nil
+}
+
+// Append writes the raw JSON of rec as a new line to the file in the zip
+// chosen by memberName
+func (s *zipStore) Append(domain string, rec record) error {
+	p := s.get(domain)
+	name := memberName(domain, rec)
+	m, ok := p.members[name]
+	if !ok {
+		m = newZipMember()
+		p.members[name] = m
+	}
+	_, err := m.Write(rec.Raw)
+	if err != nil {
+		return err
+	}
+	_, err = m.Write([]byte("\n"))
+	if err != nil {
+		return err
+	}
+	m.lines = append(m.lines, pendingLine{raw: rec.Raw, time: rec.Time})
+
+	if rec.Type != reportTypeTrustedTypes {
+		p.reports++
+		p.directives.add(rec.directive())
+		if rec.Report != nil && rec.Report.BlockedURI != "" {
+			p.blocked.add(rec.Report.BlockedURI)
+		}
+	}
+	return nil
+}
+
+// Size returns the compressed size of all files in the next zip of domain
+func (s *zipStore) Size(domain string) (size int64) {
+	for _, m := range s.get(domain).members {
+		size += int64(m.data.Len())
+	}
+	return size
+}
+
+// Rotate writes all pending reports of domain to a new .zip file named
+// example.com_YYYY-MM-DD_i.zip. The reports stay pending if the zip can't be
+// written.
+func (s *zipStore) Rotate(domain string) error {
+	p := s.get(domain)
+	if len(p.members) == 0 {
+		return nil
+	}
+
+	zipData := new(bytes.Buffer)
+	zipWriter := zip.NewWriter(zipData)
+
+	names := make([]string, 0, len(p.members))
+	for name := range p.members {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	for _, name := range names {
+		err := p.members[name].writeTo(zipWriter, name)
+		if err != nil {
+			return err
+		}
+	}
+
+	summary, err := json.MarshalIndent(zipSummary{
+		Domain:         domain,
+		Reports:        p.reports,
+		Directives:     p.directives,
+		TopBlockedURIs: p.blocked.top(maxSummaryBlockedURIs),
+	}, "", "  ")
+	if err != nil {
+		return err
+	}
+	f, err := zipWriter.Create("summary.json")
+	if err != nil {
+		return err
+	}
+	_, err = f.Write(summary)
+	if err != nil {
+		return err
+	}
+
+	// Close Zip file
+	err = zipWriter.Close()
+	if err != nil {
+		return err
+	}
+
+	err = s.create(domain, &p.fileNr, zipData.Bytes())
+	if err != nil {
+		return err
+	}
+	// Start on new zip files
+	fileNr := p.fileNr
+	*p = *newPendingZip()
+	p.fileNr = fileNr
+	return nil
+}
+
+// scanRawLines parses every line read from r as a report and calls fn with
+// it. The time of each report is set to t since raw reports don't hold the
+// time they were received.
+func scanRawLines(r io.Reader, t time.Time, fn func(rec record) error) error {
+	scanner := bufio.NewScanner(r)
+	scanner.Buffer(nil, int(globalConfig.MaxCSPReportSize)+1)
+	for scanner.Scan() {
+		line := make([]byte, len(scanner.Bytes()))
+		copy(line, scanner.Bytes())
+		records, err := parseStoredReports(line)
+		if err != nil {
+			continue // Skip lines that are not reports, e.g. Trusted Types samples
+		}
+		for _, rec := range records {
+			rec.Time = t
+			err = fn(rec)
+			if err != nil {
+				return err
+			}
+		}
+	}
+	return scanner.Err()
+}
+
+// Records calls fn for every report in the zip archive name. Reports get the
+// modification time of the archive as their time.
+func (s *zipStore) Records(name string, fn func(rec record) error) error {
+	data, modTime, err := s.read(name)
+	if err != nil {
+		return err
+	}
+	zr, err := zip.NewReader(bytes.NewReader(data), int64(len(data)))
+	if err != nil {
+		return err
+	}
+	for _, f := range zr.File {
+		if f.Name == "summary.json" {
+			continue
+		}
+		rc, err := f.Open()
+		if err != nil {
+			return err
+		}
+		err = scanRawLines(rc, modTime, func(rec record) error {
+			rec.Member = f.Name
+			return fn(rec)
+		})
+		rc.Close()
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// Pending returns a function calling fn for every report in the next zip of
+// domain, file by file in the order they are written to the zip
+func (s *zipStore) Pending(domain string) func(fn func(rec record) error) error {
+	p := s.get(domain)
+	names := make([]string, 0, len(p.members))
+	members := make(map[string][]pendingLine, len(p.members))
+	for name, m := range p.members {
+		names = append(names, name)
+		// Lines are only appended, so the copy is not changed by later
+		// reports
+		members[name] = m.lines[:len(m.lines):len(m.lines)]
+	}
+	return func(fn func(rec record) error) error {
+		sort.Strings(names)
+		for _, name := range names {
+			for _, line := range members[name] {
+				records, err := parseStoredReports(line.raw)
+				if err != nil {
+					continue // Skip lines that are not reports, e.g. Trusted Types samples
+				}
+				for _, rec := range records {
+					rec.Time = line.time
+					rec.Member = name
+					err = fn(rec)
+					if err != nil {
+						return err
+					}
+				}
+			}
+		}
+		return nil
+	}
+}
@@ -31,9 +31,11 @@ OF THIS SOFTWARE, EVEN IF ADVISED OF THE POSSIBILITY OF SUCH DAMAGE.
 package main
 
 import (
+	"crypto/tls"
 	"fmt"
 	"net"
 	"os"
+	"strconv"
 	"strings"
 	"sync"
 	"time"
@@ -70,7 +72,10 @@ const (
 	LOG_CRON
 	LOG_AUTHPRIV
 	LOG_FTP
-
+	_ // unused
+	_ // unused
+	_ // unused
+	_ // unused
 	LOG_LOCAL0
 	LOG_LOCAL1
 	LOG_LOCAL2
@@ -81,6 +86,12 @@ const (
 	LOG_LOCAL7
 )
 
+// Formats of syslog messages
+const (
+	syslogFormatBSD     = "bsd"
+	syslogFormatRFC5424 = "rfc5424"
+)
+
 // A Writer is a connection to a syslog server.
 type Writer struct {
 	priority Priority
@@ -88,10 +99,49 @@ type Writer struct {
 	hostname string
 	network  string
 	raddr    string
+	opts     dialOptions
 	mu       sync.Mutex // guards conn
 	conn     serverConn
 }
 
+// dialOptions decides how a Writer formats its messages
+type dialOptions struct {
+	// facility of every message and tag, if set, replacing the tag of
+	// every message
+	facility Priority
+	tag      string
+	// format is syslogFormatBSD or syslogFormatRFC5424
+	format string
+	// appName is the APP-NAME and pen the private enterprise number of the
+	// structured data in RFC 5424 messages
+	appName string
+	pen     int
+	// tlsConfig is used for the tls network
+	tlsConfig *tls.Config
+	// octetCounting frames messages as MSG-LEN SP SYSLOG-MSG (RFC 6587)
+	// instead of ending them with a newline
+	octetCounting bool
+}
+
+// syslogParam is a SD-PARAM in RFC 5424 messages
+type syslogParam struct {
+	Name  string `json:"name"`
+	Value string `json:"value"`
+}
+
+// syslogMessage is one message to syslog, MsgID and Params are only sent in
+// RFC 5424 messages
+type syslogMessage struct {
+	Tag string `json:"tag"`
+	// Domain is the domain the message is about, used to count dropped
+	// messages per domain
+	Domain   string        `json:"domain,omitempty"`
+	Severity Priority      `json:"severity"`
+	MsgID    string        `json:"msgid,omitempty"`
+	Params   []syslogParam `json:"params,omitempty"`
+	Msg      string        `json:"msg"`
+}
+
 // The Priority is a combination of the syslog facility and
 // severity. For example, LOG_ALERT | LOG_FTP sends an alert severity
 // message from the FTP facility. The default severity is LOG_EMERG;
@@ -108,13 +158,14 @@ const facilityMask = 0xf8
 // return a type that satisfies this interface and simply calls the C
 // library syslog function.
 type serverConn interface {
-	writeString(p Priority, hostname, tag, s, nl string) error
+	writeMessage(p Priority, hostname string, m syslogMessage) error
 	close() error
 }
 
 type netConn struct {
 	local bool
 	conn  net.Conn
+	opts  dialOptions
 }
 
 // Dial establishes a connection to a log daemon by connecting to
@@ -124,6 +175,11 @@ type netConn struct {
 // sysLog, err := syslog.Dial(globalConfig.Transport, globalConfig.Syslog,
 //                syslog.LOG_WARNING|syslog.LOG_DAEMON, name)
 func Dial(network, raddr string, priority Priority, tag string) (*Writer, error) {
+	return dialWithOptions(network, raddr, priority, tag, dialOptions{format: syslogFormatBSD})
+}
+
+// dialWithOptions is Dial for a Writer that formats messages as set in opts
+func dialWithOptions(network, raddr string, priority Priority, tag string, opts dialOptions) (*Writer, error) {
 
 	hostname, _ := os.Hostname()
 	w := &Writer{
@@ -132,6 +188,7 @@ func Dial(network, raddr string, priority Priority, tag string) (*Writer, error)
 		hostname: hostname,
 		network:  network,
 		raddr:    raddr,
+		opts:     opts,
 	}
 
 	w.mu.Lock()
@@ -154,9 +211,21 @@ func (w *Writer) connect() (err error) {
 	}
 
 	var c net.Conn
-	c, err = net.Dial(w.network, w.raddr)
+	switch w.network {
+	case "tls":
+		c, err = tls.Dial("tcp", w.raddr, w.opts.tlsConfig)
+	case "journald":
+		c, err = net.Dial("unixgram", w.raddr)
+		if err == nil {
+			w.conn = &journalConn{conn: c, opts: w.opts}
+		}
+		return
+	default:
+		c, err = net.Dial(w.network, w.raddr)
+	}
 	if err == nil {
-		w.conn = &netConn{conn: c}
+		local := w.network == "unix" || w.network == "unixgram"
+		w.conn = &netConn{local: local, conn: c, opts: w.opts}
 		if w.hostname == "" {
 			w.hostname = c.LocalAddr().String()
 		}
@@ -167,7 +236,7 @@ func (w *Writer) connect() (err error) {
 
 // Write sends a log message to the syslog daemon.
 func (w *Writer) Write(b []byte) (int, error) {
-	return w.writeAndRetry(w.priority, string(b))
+	return w.writeAndRetry(syslogMessage{Tag: w.tag, Severity: w.priority, Msg: string(b)})
 }
 
 // Close closes a connection to the syslog daemon.
@@ -183,33 +252,28 @@ func (w *Writer) Close() error {
 	return nil
 }
 
-func (w *Writer) writeAndRetry(p Priority, s string) (int, error) {
-	pr := (w.priority & facilityMask) | (p & severityMask)
+// writeAndRetry writes m with the facility of w, and reconnects once if
+// the write fails
+func (w *Writer) writeAndRetry(m syslogMessage) (int, error) {
+	pr := (w.priority & facilityMask) | (m.Severity & severityMask)
 
 	w.mu.Lock()
 	defer w.mu.Unlock()
 
 	if w.conn != nil {
-		if n, err := w.write(pr, s); err == nil {
+		if n, err := w.write(pr, m); err == nil {
 			return n, err
 		}
 	}
 	if err := w.connect(); err != nil {
 		return 0, err
 	}
-	return w.write(pr, s)
+	return w.write(pr, m)
 }
 
-// write generates and writes a syslog formatted string. The
-// format is as follows: <PRI>TIMESTAMP HOSTNAME TAG[PID]: MSG
-func (w *Writer) write(p Priority, msg string) (int, error) {
-	// ensure it ends in a \n
-	nl := ""
-	if !strings.HasSuffix(msg, "\n") {
-		nl = "\n"
-	}
-
-	err := w.conn.writeString(p, w.hostname, w.tag, msg, nl)
+// write writes m with priority p to the syslog server
+func (w *Writer) write(p Priority, m syslogMessage) (int, error) {
+	err := w.conn.writeMessage(p, w.hostname, m)
 	if err != nil {
 		return 0, err
 	}
@@ -217,17 +281,96 @@ func (w *Writer) write(p Priority, msg string) (int, error) {
 	// Note: return the length of the input, not the number of
 	// bytes printed by Fprintf, because this must behave like
 	// an io.Writer.
-	return len(msg), nil
+	return len(m.Msg), nil
 }
 
-func (n *netConn) writeString(p Priority, hostname, tag, msg, nl string) error {
-	timestamp := time.Now().Format(time.RFC3339)
-	_, err := fmt.Fprintf(n.conn, "<%d>%s %s %s[%d]: %s%s",
-		p, timestamp, hostname,
-		tag, os.Getpid(), msg, nl)
+// writeMessage generates and writes a syslog formatted string. The BSD
+// format is as follows: <PRI>TIMESTAMP HOSTNAME TAG[PID]: MSG
+// and RFC 5424: <PRI>1 TIMESTAMP HOSTNAME APP-NAME PROCID MSGID SD MSG
+// With octet counting the message is sent as MSG-LEN SP SYSLOG-MSG.
+func (n *netConn) writeMessage(p Priority, hostname string, m syslogMessage) error {
+	tag := m.Tag
+	if n.opts.tag != "" {
+		tag = n.opts.tag
+	}
+	var msg string
+	if n.opts.format == syslogFormatRFC5424 {
+		timestamp := time.Now().Format("2006-01-02T15:04:05.000000Z07:00")
+		msg = fmt.Sprintf("<%d>1 %s %s %s %d %s %s %s",
+			p, timestamp, headerField(hostname, 255), headerField(n.opts.appName, 48),
+			os.Getpid(), headerField(m.MsgID, 32), structuredData(n.opts.pen, m.Params), m.Msg)
+	} else if n.local {
+		// Compared to the network form below, the changes are:
+		//	1. Use time.Stamp instead of time.RFC3339.
+		//	2. Drop the hostname field.
+		msg = fmt.Sprintf("<%d>%s %s[%d]: %s",
+			p, time.Now().Format(time.Stamp),
+			tag, os.Getpid(), m.Msg)
+	} else {
+		timestamp := time.Now().Format(time.RFC3339)
+		msg = fmt.Sprintf("<%d>%s %s %s[%d]: %s",
+			p, timestamp, hostname,
+			tag, os.Getpid(), m.Msg)
+	}
+
+	if n.opts.octetCounting {
+		_, err := fmt.Fprintf(n.conn, "%d %s", len(msg), msg)
+		return err
+	}
+	// ensure it ends in a \n
+	if !strings.HasSuffix(msg, "\n") {
+		msg += "\n"
+	}
+	_, err := n.conn.Write([]byte(msg))
 	return err
 }
 
+// headerField returns s as a RFC 5424 header field of at most max printable
+// US-ASCII characters, or the NILVALUE "-" if s is empty
+func headerField(s string, max int) string {
+	field := []byte(s)
+	if len(field) > max {
+		field = field[:max]
+	}
+	for i, c := range field {
+		if c < 33 || c > 126 {
+			field[i] = '_'
+		}
+	}
+	if len(field) == 0 {
+		return "-"
+	}
+	return string(field)
+}
+
+// structuredData returns params as the RFC 5424 SD-ELEMENT
+// [csp@pen name="value" ...], params with empty values are left out
+func structuredData(pen int, params []syslogParam) string {
+	var sd strings.Builder
+	for _, param := range params {
+		if param.Value == "" {
+			continue
+		}
+		if sd.Len() == 0 {
+			sd.WriteString("[csp@" + strconv.Itoa(pen))
+		}
+		sd.WriteString(" " + param.Name + `="`)
+		// '"', '\' and ']' must be escaped in PARAM-VALUE
+		for _, r := range param.Value {
+			if r == '"' || r == '\\' || r == ']' {
+				sd.WriteByte('\\')
+			}
+			sd.WriteRune(r)
+		}
+		sd.WriteByte('"')
+	}
+	if sd.Len() == 0 {
+		return "-"
+	}
+	sd.WriteByte(']')
+	return sd.String()
+}
+
 func (n *netConn) close() error {
 	return n.conn.Close()
 }
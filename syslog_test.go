@@ -0,0 +1,228 @@
+package main
+
+import (
+	"bufio"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"io"
+	"math/big"
+	"net"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+)
+
+// testCA is a certificate authority issuing certificates for tests
+type testCA struct {
+	cert *x509.Certificate
+	key  *ecdsa.PrivateKey
+	pool *x509.CertPool
+}
+
+func newTestCA(t *testing.T) *testCA {
+	t.Helper()
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	template := &x509.Certificate{
+		SerialNumber:          big.NewInt(1),
+		Subject:               pkix.Name{CommonName: "cspreporter test CA"},
+		NotBefore:             time.Now().Add(-time.Hour),
+		NotAfter:              time.Now().Add(time.Hour),
+		IsCA:                  true,
+		KeyUsage:              x509.KeyUsageCertSign,
+		BasicConstraintsValid: true,
+	}
+	der, err := x509.CreateCertificate(rand.Reader, template, template, &key.PublicKey, key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	cert, err := x509.ParseCertificate(der)
+	if err != nil {
+		t.Fatal(err)
+	}
+	pool := x509.NewCertPool()
+	pool.AddCert(cert)
+	return &testCA{cert: cert, key: key, pool: pool}
+}
+
+// issue returns a certificate for 127.0.0.1 signed by ca, usable by servers
+// and clients
+func (ca *testCA) issue(t *testing.T, name string) tls.Certificate {
+	t.Helper()
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	template := &x509.Certificate{
+		SerialNumber: big.NewInt(time.Now().UnixNano()),
+		Subject:      pkix.Name{CommonName: name},
+		NotBefore:    time.Now().Add(-time.Hour),
+		NotAfter:     time.Now().Add(time.Hour),
+		KeyUsage:     x509.KeyUsageDigitalSignature,
+		ExtKeyUsage:  []x509.ExtKeyUsage{x509.ExtKeyUsageServerAuth, x509.ExtKeyUsageClientAuth},
+		IPAddresses:  []net.IP{net.ParseIP("127.0.0.1")},
+	}
+	der, err := x509.CreateCertificate(rand.Reader, template, ca.cert, &key.PublicKey, ca.key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return tls.Certificate{Certificate: [][]byte{der}, PrivateKey: key}
+}
+
+// startTLSServer accepts one connection on a TLS listener that requires a
+// client certificate signed by ca, and sends everything read from it, or the
+// handshake error, on the returned channels
+func startTLSServer(t *testing.T, ca *testCA) (addr string, received chan []byte, handshake chan error) {
+	t.Helper()
+	ln, err := tls.Listen("tcp", "127.0.0.1:0", &tls.Config{
+		Certificates: []tls.Certificate{ca.issue(t, "server")},
+		ClientAuth:   tls.RequireAndVerifyClientCert,
+		ClientCAs:    ca.pool,
+		MinVersion:   tls.VersionTLS12,
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { ln.Close() })
+
+	received = make(chan []byte, 1)
+	handshake = make(chan error, 1)
+	go func() {
+		conn, err := ln.Accept()
+		if err != nil {
+			handshake <- err
+			return
+		}
+		defer conn.Close()
+		conn.SetDeadline(time.Now().Add(5 * time.Second))
+		err = conn.(*tls.Conn).Handshake()
+		handshake <- err
+		if err != nil {
+			return
+		}
+		data, _ := io.ReadAll(conn)
+		received <- data
+	}()
+	return ln.Addr().String(), received, handshake
+}
+
+// readFrame reads one octet-counted frame, MSG-LEN SP SYSLOG-MSG, from r
+func readFrame(r *bufio.Reader) (string, error) {
+	length, err := r.ReadString(' ')
+	if err != nil {
+		return "", err
+	}
+	n, err := strconv.Atoi(strings.TrimSuffix(length, " "))
+	if err != nil {
+		return "", err
+	}
+	msg := make([]byte, n)
+	_, err = io.ReadFull(r, msg)
+	return string(msg), err
+}
+
+func TestSyslogTLSOctetCounting(t *testing.T) {
+	ca := newTestCA(t)
+	addr, received, handshake := startTLSServer(t, ca)
+
+	w, err := dialWithOptions("tls", addr, LOG_DAEMON, "", dialOptions{
+		format:        syslogFormatRFC5424,
+		appName:       "cspreporter",
+		octetCounting: true,
+		tlsConfig: &tls.Config{
+			RootCAs:      ca.pool,
+			Certificates: []tls.Certificate{ca.issue(t, "client")},
+			MinVersion:   tls.VersionTLS12,
+		},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	messages := []string{"first line\nsecond line", "next message"}
+	for _, msg := range messages {
+		_, err = w.writeAndRetry(syslogMessage{Tag: "example.com", Severity: LOG_WARNING, MsgID: reportTypeCSP, Msg: msg})
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+	w.Close()
+
+	if err := <-handshake; err != nil {
+		t.Fatal("handshake :", err)
+	}
+	r := bufio.NewReader(strings.NewReader(string(<-received)))
+	for _, msg := range messages {
+		frame, err := readFrame(r)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if !strings.HasPrefix(frame, "<28>1 ") {
+			t.Errorf("frame %q does not start with the RFC 5424 header", frame)
+		}
+		if !strings.HasSuffix(frame, " "+msg) {
+			t.Errorf("frame %q does not end with %q", frame, msg)
+		}
+	}
+	if rest, _ := io.ReadAll(r); len(rest) > 0 {
+		t.Errorf("unexpected data after the frames: %q", rest)
+	}
+}
+
+func TestSyslogTLSRejectsUnknownServerCA(t *testing.T) {
+	ca := newTestCA(t)
+	addr, _, _ := startTLSServer(t, ca)
+
+	other := newTestCA(t)
+	_, err := dialWithOptions("tls", addr, LOG_DAEMON, "", dialOptions{
+		octetCounting: true,
+		tlsConfig: &tls.Config{
+			RootCAs:      other.pool,
+			Certificates: []tls.Certificate{ca.issue(t, "client")},
+			MinVersion:   tls.VersionTLS12,
+		},
+	})
+	if err == nil {
+		t.Fatal("dial succeeded with a server certificate from an unknown CA")
+	}
+}
+
+func TestSyslogTLSRejectsClientCertificate(t *testing.T) {
+	ca := newTestCA(t)
+	other := newTestCA(t)
+	for name, certs := range map[string][]tls.Certificate{
+		"no certificate": nil,
+		"other CA":       {other.issue(t, "client")},
+	} {
+		t.Run(name, func(t *testing.T) {
+			addr, received, handshake := startTLSServer(t, ca)
+			w, err := dialWithOptions("tls", addr, LOG_DAEMON, "", dialOptions{
+				octetCounting: true,
+				tlsConfig: &tls.Config{
+					RootCAs:      ca.pool,
+					Certificates: certs,
+					MinVersion:   tls.VersionTLS12,
+				},
+			})
+			if err == nil {
+				// With TLS 1.3 the client finishes its handshake before the
+				// server checks the client certificate
+				w.Close()
+			}
+			if err := <-handshake; err == nil {
+				t.Fatal("server accepted the client certificate")
+			}
+			select {
+			case data := <-received:
+				t.Fatalf("server received %q", data)
+			default:
+			}
+		})
+	}
+}
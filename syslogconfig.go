@@ -0,0 +1,171 @@
+package main
+
+import (
+	"errors"
+	"strings"
+	"text/template"
+)
+
+// defaultSyslogTemplate is the message sent for every report without
+// SyslogTemplate
+const defaultSyslogTemplate = "{{.Label}} report from Domain {{.Domain}} : {{.Raw}}"
+
+// syslogFacilities are the names that can be used in SyslogFacility
+var syslogFacilities = map[string]Priority{
+	"kern":     LOG_KERN,
+	"user":     LOG_USER,
+	"mail":     LOG_MAIL,
+	"daemon":   LOG_DAEMON,
+	"auth":     LOG_AUTH,
+	"syslog":   LOG_SYSLOG,
+	"lpr":      LOG_LPR,
+	"news":     LOG_NEWS,
+	"uucp":     LOG_UUCP,
+	"cron":     LOG_CRON,
+	"authpriv": LOG_AUTHPRIV,
+	"ftp":      LOG_FTP,
+	"local0":   LOG_LOCAL0,
+	"local1":   LOG_LOCAL1,
+	"local2":   LOG_LOCAL2,
+	"local3":   LOG_LOCAL3,
+	"local4":   LOG_LOCAL4,
+	"local5":   LOG_LOCAL5,
+	"local6":   LOG_LOCAL6,
+	"local7":   LOG_LOCAL7,
+}
+
+// syslogSeverities are the names that can be used in SyslogSeverity
+var syslogSeverities = map[string]Priority{
+	"emerg":   LOG_EMERG,
+	"alert":   LOG_ALERT,
+	"crit":    LOG_CRIT,
+	"err":     LOG_ERR,
+	"warning": LOG_WARNING,
+	"notice":  LOG_NOTICE,
+	"info":    LOG_INFO,
+	"debug":   LOG_DEBUG,
+}
+
+// syslogSeverityRule sets the severity of the reports it matches. Type,
+// Disposition (enforce or report) and Directive only match if set, so a rule
+// with only Severity matches every report.
+type syslogSeverityRule struct {
+	Type        string
+	Disposition string
+	Directive   string
+	Severity    string
+
+	severity Priority
+}
+
+// match reports whether the rule matches rec
+func (rule syslogSeverityRule) match(rec record) bool {
+	if rule.Type != "" && rule.Type != rec.Type {
+		return false
+	}
+	if rule.Disposition != "" && (rec.Report == nil || rule.Disposition != rec.Report.Disposition) {
+		return false
+	}
+	if rule.Directive != "" && (rec.Report == nil || rule.Directive != newViolationKey(rec.Report).Directive) {
+		return false
+	}
+	return true
+}
+
+// syslogTemplateData is passed to SyslogTemplate for every report
+type syslogTemplateData struct {
+	Domain string
+	// Type is the report type, e.g. csp-violation, and Label its name,
+	// e.g. CSP
+	Type  string
+	Label string
+	// Directive is the effective directive of CSP violations, or the report
+	// type for other reports
+	Directive string
+	URL       string
+	// Raw is the JSON of the report as it was received
+	Raw    string
+	Report *report
+	Body   interface{}
+}
+
+// setupSyslogMessages parses SyslogFacility, SyslogSeverity,
+// SyslogAlertSeverity and SyslogTemplate
+func setupSyslogMessages() error {
+	if globalConfig.SyslogFacility == "" {
+		globalConfig.SyslogFacility = "daemon"
+	}
+	facility, ok := syslogFacilities[strings.ToLower(globalConfig.SyslogFacility)]
+	if !ok {
+		return errors.New("Invalid config, unknown SyslogFacility " + globalConfig.SyslogFacility)
+	}
+	globalSyslogFacility = facility
+
+	for i, rule := range globalConfig.SyslogSeverity {
+		severity, ok := syslogSeverities[strings.ToLower(rule.Severity)]
+		if !ok {
+			return errors.New("Invalid config, unknown SyslogSeverity " + rule.Severity)
+		}
+		globalConfig.SyslogSeverity[i].severity = severity
+		globalConfig.SyslogSeverity[i].Directive = strings.ToLower(rule.Directive)
+	}
+
+	if globalConfig.SyslogAlertSeverity == "" {
+		globalConfig.SyslogAlertSeverity = "crit"
+	}
+	alert, ok := syslogSeverities[strings.ToLower(globalConfig.SyslogAlertSeverity)]
+	if !ok {
+		return errors.New("Invalid config, unknown SyslogAlertSeverity " + globalConfig.SyslogAlertSeverity)
+	}
+	// Lower values are more severe, alerts must stand out from every report
+	if alert >= LOG_WARNING {
+		return errors.New("Invalid config, SyslogAlertSeverity must be above warning, the severity of reports without a SyslogSeverity rule")
+	}
+	for _, rule := range globalConfig.SyslogSeverity {
+		if alert >= rule.severity {
+			return errors.New("Invalid config, SyslogAlertSeverity must be above the SyslogSeverity rule with " + rule.Severity)
+		}
+	}
+	globalSyslogAlertSeverity = alert
+
+	if globalConfig.SyslogTemplate == "" {
+		globalConfig.SyslogTemplate = defaultSyslogTemplate
+	}
+	t, err := template.New("syslog").Parse(globalConfig.SyslogTemplate)
+	if err != nil {
+		return err
+	}
+	globalSyslogTemplate = t
+	return nil
+}
+
+// syslogSeverity returns the severity of the first rule in SyslogSeverity
+// matching rec, or LOG_WARNING
+func syslogSeverity(rec record) Priority {
+	for _, rule := range globalConfig.SyslogSeverity {
+		if rule.match(rec) {
+			return rule.severity
+		}
+	}
+	return LOG_WARNING
+}
+
+// syslogText renders SyslogTemplate for rec received by domain name
+func syslogText(name string, rec record) (string, error) {
+	directive := rec.directive()
+	if rec.Report != nil {
+		directive = newViolationKey(rec.Report).Directive
+	}
+	var text strings.Builder
+	err := globalSyslogTemplate.Execute(&text, syslogTemplateData{
+		Domain:    name,
+		Type:      rec.Type,
+		Label:     reportTypeLabels[rec.Type],
+		Directive: directive,
+		URL:       rec.URL,
+		Raw:       string(rec.Raw),
+		Report:    rec.Report,
+		Body:      rec.Body,
+	})
+	return text.String(), err
+}
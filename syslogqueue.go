@@ -0,0 +1,366 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/json"
+	"errors"
+	"io"
+	"io/ioutil"
+	"log"
+	"os"
+	"sync"
+	"time"
+)
+
+// Overflow policies of the syslog queue
+const (
+	syslogOverflowDropOldest = "drop-oldest"
+	syslogOverflowBlock      = "block"
+	syslogOverflowSpill      = "spill"
+)
+
+// Framing of syslog messages over tcp and tls
+const (
+	syslogFramingOctetCounting = "octet-counting"
+	syslogFramingNewline       = "newline"
+)
+
+// Wait between attempts to reach the syslog server, doubled after every
+// failed attempt
+const (
+	syslogMinBackoff = time.Second
+	syslogMaxBackoff = time.Minute
+)
+
+// syslogBlockTimeout is the longest the block overflow policy waits for room
+// in the queue before dropping the message, well within the WriteTimeout of
+// the report server
+const syslogBlockTimeout = 2 * time.Second
+
+// maxSpillLineSize is the longest line read from the spill file on startup
+const maxSpillLineSize = 1 << 24
+
+// syslogQueue sends syslog messages in order over one long-lived connection.
+// Messages that do not fit are spilled as JSON lines, encrypted with
+// encryptLine if Encryption is set.
+// At most SyslogQueueSize messages wait in memory, SyslogOverflow decides
+// what happens to the rest.
+type syslogQueue struct {
+	mutex sync.Mutex
+	// cond is broadcast when messages are queued, sent or dropped
+	cond     *sync.Cond
+	messages []syslogMessage
+	max      int
+	overflow string
+	// sending is set while the first message is being written
+	sending bool
+	// stalled is set when the block policy timed out, messages are dropped
+	// without waiting until the next message is sent
+	stalled bool
+	// dropped counts the messages dropped by domain
+	dropped counter
+
+	// spill holds the messages that did not fit in memory, spilled is the
+	// number of unread messages in it and spillRead the offset of the first
+	spill     *os.File
+	spilled   int
+	spillRead int64
+}
+
+// syslogDialOptions returns the dialOptions for the configured syslog
+// server, loading the certificates used by the tls transport
+func syslogDialOptions() (dialOptions, error) {
+	opts := dialOptions{
+		facility: globalSyslogFacility,
+		tag:      globalConfig.SyslogTag,
+		format:   globalConfig.SyslogFormat,
+		appName:  globalConfig.SyslogAppName,
+		pen:      globalConfig.SyslogPEN,
+	}
+	switch globalConfig.SyslogFraming {
+	case "":
+		// RFC 5425 requires octet counting over TLS
+		opts.octetCounting = globalConfig.Transport == "tls"
+	case syslogFramingOctetCounting:
+		if globalConfig.Transport != "tcp" && globalConfig.Transport != "tls" {
+			return opts, errors.New("Invalid config, SyslogFraming octet-counting needs Transport tcp or tls")
+		}
+		opts.octetCounting = true
+	case syslogFramingNewline:
+	default:
+		return opts, errors.New("Invalid config, SyslogFraming must be octet-counting or newline")
+	}
+	if globalConfig.Transport != "tls" {
+		return opts, nil
+	}
+
+	opts.tlsConfig = &tls.Config{ServerName: globalConfig.SyslogServerName, MinVersion: tls.VersionTLS12}
+	if globalConfig.SyslogCAFile != "" {
+		pem, err := ioutil.ReadFile(globalConfig.SyslogCAFile)
+		if err != nil {
+			return opts, err
+		}
+		opts.tlsConfig.RootCAs = x509.NewCertPool()
+		if !opts.tlsConfig.RootCAs.AppendCertsFromPEM(pem) {
+			return opts, errors.New("No certificates found in SyslogCAFile")
+		}
+	}
+	if globalConfig.SyslogCertFile != "" || globalConfig.SyslogKeyFile != "" {
+		cert, err := tls.LoadX509KeyPair(globalConfig.SyslogCertFile, globalConfig.SyslogKeyFile)
+		if err != nil {
+			return opts, err
+		}
+		opts.tlsConfig.Certificates = []tls.Certificate{cert}
+	}
+	return opts, nil
+}
+
+// newSyslogQueue starts sending the messages of a new syslogQueue to
+// network and raddr formatted as set in opts. Messages spilled to spillPath before a restart are sent
+// before new ones.
+func newSyslogQueue(network, raddr string, opts dialOptions, max int, overflow, spillPath string) (*syslogQueue, error) {
+	q := &syslogQueue{max: max, overflow: overflow, dropped: make(counter)}
+	q.cond = sync.NewCond(&q.mutex)
+	if overflow == syslogOverflowSpill {
+		f, err := os.OpenFile(spillPath, os.O_RDWR|os.O_CREATE|os.O_APPEND, 0600)
+		if err != nil {
+			return nil, err
+		}
+		end, skipped, err := readLines(f, maxSpillLineSize, func([]byte) {
+			q.spilled++
+		})
+		if err == nil {
+			// Lines that are too long are skipped when they are read back
+			q.spilled += skipped
+			err = dropTornLine(f, end)
+			if err == errTornLine {
+				log.Println("syslogQueue :", spillPath, ":", err)
+				q.dropped.add("")
+				err = nil
+			}
+		}
+		if err != nil {
+			f.Close()
+			return nil, err
+		}
+		q.spill = f
+	}
+	go q.run(network, raddr, opts)
+	return q, nil
+}
+
+// send queues m
+func (q *syslogQueue) send(m syslogMessage) {
+	q.mutex.Lock()
+	defer q.mutex.Unlock()
+
+	switch q.overflow {
+	case syslogOverflowBlock:
+		if len(q.messages) >= q.max && !q.stalled {
+			deadline := time.Now().Add(syslogBlockTimeout)
+			timer := time.AfterFunc(syslogBlockTimeout, func() {
+				q.mutex.Lock()
+				q.cond.Broadcast()
+				q.mutex.Unlock()
+			})
+			for len(q.messages) >= q.max && time.Now().Before(deadline) {
+				q.cond.Wait()
+			}
+			timer.Stop()
+			q.stalled = len(q.messages) >= q.max
+		}
+		if len(q.messages) >= q.max {
+			q.dropped.add(m.Domain)
+			return
+		}
+	case syslogOverflowSpill:
+		// Once spilling, new messages must follow the spilled ones
+		if q.spilled > 0 || len(q.messages) >= q.max {
+			err := q.spillMessage(m)
+			if err == nil {
+				q.cond.Broadcast()
+				return
+			}
+			log.Println("syslogQueue.spillMessage() :", err)
+			q.dropped.add(m.Domain)
+			return
+		}
+	default:
+		if len(q.messages) >= q.max {
+			// The first message may be in flight
+			i := 0
+			if q.sending {
+				i = 1
+			}
+			if i >= len(q.messages) {
+				q.dropped.add(m.Domain)
+				return
+			}
+			q.dropped.add(q.messages[i].Domain)
+			q.messages = append(q.messages[:i], q.messages[i+1:]...)
+		}
+	}
+	q.messages = append(q.messages, m)
+	q.cond.Broadcast()
+}
+
+// spillMessage appends m to the spill file.
+// It must be called with q.mutex held.
+func (q *syslogQueue) spillMessage(m syslogMessage) error {
+	b, err := json.Marshal(m)
+	if err != nil {
+		return err
+	}
+	b, err = encryptLine(b)
+	if err != nil {
+		return err
+	}
+	info, err := q.spill.Stat()
+	if err != nil {
+		return err
+	}
+	_, err = q.spill.Write(append(b, '\n'))
+	if err != nil {
+		// Don't leave a torn line for the next message to join
+		q.spill.Truncate(info.Size())
+		return err
+	}
+	q.spilled++
+	return nil
+}
+
+// unspill moves up to q.max spilled messages to the queue, and empties the
+// spill file once all are read. Lines that can't be decoded are skipped and
+// counted as dropped.
+// It must be called with q.mutex held.
+func (q *syslogQueue) unspill() error {
+	_, err := q.spill.Seek(q.spillRead, io.SeekStart)
+	if err != nil {
+		return err
+	}
+	r := bufio.NewReader(q.spill)
+	for q.spilled > 0 && len(q.messages) < q.max {
+		line, err := r.ReadBytes('\n')
+		if err == io.EOF {
+			// The file holds fewer complete lines than were spilled
+			log.Println("syslogQueue.unspill() :", q.spilled, "spilled messages are missing")
+			q.dropped[""] += int64(q.spilled)
+			q.spilled = 0
+			break
+		}
+		if err != nil {
+			return err
+		}
+		q.spillRead += int64(len(line))
+		q.spilled--
+		line, err = decryptLine(bytes.TrimSuffix(line, []byte("\n")))
+		if err != nil {
+			log.Println("syslogQueue.unspill() :", err)
+			q.dropped.add("")
+			continue // Skip if errors
+		}
+		var m syslogMessage
+		if json.Unmarshal(line, &m) != nil {
+			q.dropped.add("")
+			continue // Skip if errors
+		}
+		q.messages = append(q.messages, m)
+	}
+	if q.spilled == 0 {
+		q.spillRead = 0
+		return q.spill.Truncate(0)
+	}
+	return nil
+}
+
+// run sends queued messages, reconnecting with backoff while the syslog
+// server can't be reached.
+// Note that run will not return so call it in a new gorutine.
+func (q *syslogQueue) run(network, raddr string, opts dialOptions) {
+	var w *Writer
+	backoff := syslogMinBackoff
+	for {
+		q.mutex.Lock()
+		for len(q.messages) == 0 {
+			if q.spilled == 0 {
+				q.cond.Wait()
+				continue
+			}
+			err := q.unspill()
+			if err != nil {
+				// The spill file can't be read, every unread message is lost
+				log.Println("syslogQueue.unspill() :", err)
+				q.dropped[""] += int64(q.spilled)
+				q.spilled, q.spillRead = 0, 0
+				q.spill.Truncate(0)
+			}
+		}
+		m := q.messages[0]
+		q.sending = true
+		q.mutex.Unlock()
+
+		var err error
+		if w == nil {
+			w, err = dialWithOptions(network, raddr, opts.facility, "", opts)
+		}
+		if err == nil {
+			_, err = w.writeAndRetry(m)
+		}
+
+		q.mutex.Lock()
+		q.sending = false
+		if err == nil {
+			q.messages = q.messages[1:]
+			q.stalled = false
+			backoff = syslogMinBackoff
+		}
+		q.cond.Broadcast()
+		q.mutex.Unlock()
+
+		if err != nil {
+			if !globalConfig.Silent {
+				log.Println("syslog :", err, "retrying in", backoff)
+			}
+			time.Sleep(backoff)
+			backoff *= 2
+			if backoff > syslogMaxBackoff {
+				backoff = syslogMaxBackoff
+			}
+		}
+	}
+}
+
+// wait blocks until all messages in memory are sent or ctx is done. Spilled
+// messages are sent after the next start.
+func (q *syslogQueue) wait(ctx context.Context) error {
+	done := make(chan struct{})
+	go func() {
+		q.mutex.Lock()
+		for (len(q.messages) > 0 || q.sending) && ctx.Err() == nil {
+			q.cond.Wait()
+		}
+		q.mutex.Unlock()
+		close(done)
+	}()
+	select {
+	case <-done:
+		return nil
+	case <-ctx.Done():
+		// Wake up the waiting go rutine so it can return
+		q.mutex.Lock()
+		q.cond.Broadcast()
+		q.mutex.Unlock()
+		return ctx.Err()
+	}
+}
+
+// droppedFor returns the number of messages about domain that were dropped
+func (q *syslogQueue) droppedFor(domain string) int64 {
+	q.mutex.Lock()
+	defer q.mutex.Unlock()
+	return q.dropped[domain]
+}